@@ -9,7 +9,6 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/aakso/gcaruna/parser"
@@ -38,7 +37,7 @@ const (
 	CarunaApiSeriesQueryParamResolution      = "resolution"
 	CarunaApiSeriesQueryParamResolutionValue = "MONTHS_AS_HOURS"
 	CarunaApiSeriesQueryParamProductValue    = "EL_ENERGY_CONSUMPTION"
-	CarunaApiSeriesQueryParamCustomer    = "customerNumber"
+	CarunaApiSeriesQueryParamCustomer        = "customerNumber"
 
 	// Caruna API uses ISO8601 timestamps but doesn't allow the Z sign
 	CarunaTimeLayout = "2006-01-02T15:04:05-0700"
@@ -55,6 +54,8 @@ type HourlyEnergyMeasurement struct {
 	MeteringPointLocation []string
 	Timestamp             time.Time
 	Value                 float64
+	// Caruna status of the value, estimated values are later revised
+	Status string
 }
 
 type MeteringPoint struct {
@@ -201,7 +202,6 @@ func (self *CarunaClient) GetHourlySeries(meteringPointStr string, timeStart, ti
 		return nil, fmt.Errorf("timeStart is after timeStop")
 	}
 
-	rawMeasurements := make([]RawMeasurement, 0)
 	ret := make([]HourlyEnergyMeasurement, 0)
 
 	meteringPoints, err := self.GetMeteringPoints()
@@ -211,70 +211,80 @@ func (self *CarunaClient) GetHourlySeries(meteringPointStr string, timeStart, ti
 
 	// Loop over all meteringpoints
 	for _, e := range meteringPoints {
-		meteringPointId := e.MeteringPointNumber
-		meteringPointLocation := e.Location
-
 		// If user has specified a meteringpoint filter, evaluate and skip all that don't match
-		if meteringPointStr != "" {
-			match := e.MeteringPointNumber == meteringPointStr ||
-				strings.Contains(strings.Join(e.Location, " "), meteringPointStr)
-
-			if !match {
-				self.Logger.Println("Skipping meteringpoint:", meteringPointId)
-				continue
-
-			}
+		if !MatchMeteringPoint(e, meteringPointStr) {
+			self.Logger.Println("Skipping meteringpoint:", e.MeteringPointNumber)
+			continue
 		}
 
-		// Construct url and parameters
-		reqUrl, err := url.Parse(fmt.Sprintf(CarunaApiUriSeries, meteringPointId))
+		hms, err := self.GetMeteringPointSeries(e, timeStart, timeStop)
 		if err != nil {
 			return nil, err
 		}
-		params := &url.Values{}
+		ret = append(ret, hms...)
+	} // Meteringpoint loop
+	return ret, nil
+}
 
-		params.Set(CarunaApiSeriesQueryParamProduct, CarunaApiSeriesQueryParamProductValue)
-		params.Set(CarunaApiSeriesQueryParamResolution, CarunaApiSeriesQueryParamResolutionValue)
-		params.Set(CarunaApiSeriesQueryParamTimeStart, timeStart.Format(CarunaTimeLayout))
-		params.Set(CarunaApiSeriesQueryParamTimeStop, timeStop.Format(CarunaTimeLayout))
-		params.Set(CarunaApiSeriesQueryParamCustomer, self.CustomerInfo.Username)
+func (self *CarunaClient) GetMeteringPointSeries(mp MeteringPoint, timeStart, timeStop time.Time) ([]HourlyEnergyMeasurement, error) {
+	rawMeasurements := make([]RawMeasurement, 0)
+	ret := make([]HourlyEnergyMeasurement, 0)
 
-		reqUrl.RawQuery = params.Encode()
+	// Construct url and parameters
+	reqUrl, err := url.Parse(fmt.Sprintf(CarunaApiUriSeries, mp.MeteringPointNumber))
+	if err != nil {
+		return nil, err
+	}
+	params := &url.Values{}
 
-		resp, err := self.GetPage(reqUrl.String())
-		if err != nil {
-			return nil, err
-		}
+	params.Set(CarunaApiSeriesQueryParamProduct, CarunaApiSeriesQueryParamProductValue)
+	params.Set(CarunaApiSeriesQueryParamResolution, CarunaApiSeriesQueryParamResolutionValue)
+	params.Set(CarunaApiSeriesQueryParamTimeStart, timeStart.Format(CarunaTimeLayout))
+	params.Set(CarunaApiSeriesQueryParamTimeStop, timeStop.Format(CarunaTimeLayout))
+	params.Set(CarunaApiSeriesQueryParamCustomer, self.CustomerInfo.Username)
 
-		// Parse response
-		err = json.Unmarshal(resp.Data, &rawMeasurements)
-		if err != nil {
-			return nil, err
-		}
+	reqUrl.RawQuery = params.Encode()
+
+	resp, err := self.GetPage(reqUrl.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse response
+	err = json.Unmarshal(resp.Data, &rawMeasurements)
+	if err != nil {
+		return nil, err
+	}
 
-		// Make response
-		for _, v := range rawMeasurements {
-			// Skip missing values
-			if !v.HourlyMeasured {
-				continue
-			}
-
-			ts, err := time.Parse(CarunaTimeLayout, v.Timestamp)
-			if err != nil {
-				return nil, fmt.Errorf("Couldn't parse measurement timestamp: %s", err)
-			}
-			ret = append(ret, HourlyEnergyMeasurement{
-				Timestamp:             ts,
-				MeteringPointId:       meteringPointId,
-				MeteringPointLocation: meteringPointLocation,
-				Value: v.Values.EnergyConsumption.Value,
-			})
+	// Make response
+	for _, v := range rawMeasurements {
+		// Skip missing values
+		if !v.HourlyMeasured {
+			continue
 		}
 
-	} // Meteringpoint loop
+		ts, err := time.Parse(CarunaTimeLayout, v.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse measurement timestamp: %s", err)
+		}
+		ret = append(ret, HourlyEnergyMeasurement{
+			Timestamp:             ts.UTC(),
+			MeteringPointId:       mp.MeteringPointNumber,
+			MeteringPointLocation: mp.Location,
+			Value:                 v.Values.EnergyConsumption.Value,
+			Status:                v.Values.EnergyConsumption.Status,
+		})
+	}
 	return ret, nil
 }
 
+func (self *CarunaClient) Customer() string {
+	if self.CustomerInfo == nil {
+		return ""
+	}
+	return self.CustomerInfo.Username
+}
+
 func (self *CarunaClient) Logout() error {
 	resp, err := self.GetPage(CarunaApiLogout)
 	if err != nil {
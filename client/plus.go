@@ -0,0 +1,477 @@
+package caruna
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aakso/gcaruna/parser"
+)
+
+const (
+	CarunaPlusBase     = "https://plus.caruna.fi"
+	CarunaPlusAuthBase = "https://authentication2.caruna.fi"
+	CarunaPlusClientId = "caruna-plus"
+
+	// OIDC endpoints, relative to the authorization server
+	CarunaPlusAuthorizeUri = "/oauth2/authorize"
+	CarunaPlusTokenUri     = "/oauth2/token"
+	CarunaPlusScope        = "openid"
+
+	// Caruna Plus login form components
+	CarunaPlusLoginFieldUsername = "username"
+	CarunaPlusLoginFieldPassword = "password"
+
+	// Caruna Plus API paths, relative to the API base
+	CarunaPlusApiUriCurrentUser = "/api/users/current"
+	CarunaPlusApiUriAssets      = "/api/customers/%s/assets"           // params: customer number
+	CarunaPlusApiUriEnergy      = "/api/customers/%s/assets/%s/energy" // params: customer number, asset id
+
+	// Caruna Plus API energy query parameters
+	CarunaPlusApiEnergyQueryParamTimespan      = "timespan"
+	CarunaPlusApiEnergyQueryParamTimespanValue = "daily"
+	CarunaPlusApiEnergyQueryParamYear          = "year"
+	CarunaPlusApiEnergyQueryParamMonth         = "month"
+	CarunaPlusApiEnergyQueryParamDay           = "day"
+
+	// Energy is queried per calendar day in this zone
+	CarunaPlusTimeZone = "Europe/Helsinki"
+
+	// Access token is refreshed when it is this close to expiry
+	CarunaPlusTokenRefreshMargin = 30 * time.Second
+)
+
+type PlusClientOpts struct {
+	Logger      *log.Logger
+	AuthUrl     string
+	ApiUrl      string
+	ClientId    string
+	RedirectUrl string
+}
+
+type plusAssetRef struct {
+	customer string
+	assetId  string
+}
+
+type CarunaPlusClient struct {
+	AuthUrl     string
+	ApiUrl      string
+	ClientId    string
+	RedirectUrl string
+	Client      *http.Client
+	UserInfo    *PlusUserInfo
+	Logger      *log.Logger
+
+	token       *PlusTokenResponse
+	tokenExpiry time.Time
+	assets      map[string]plusAssetRef
+	location    *time.Location
+}
+
+func (self *CarunaPlusClient) Authenticate(username, password string) error {
+	state, err := randomState()
+	if err != nil {
+		return err
+	}
+
+	authUrl, err := url.Parse(self.AuthUrl + CarunaPlusAuthorizeUri)
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", self.ClientId)
+	params.Set("redirect_uri", self.RedirectUrl)
+	params.Set("scope", CarunaPlusScope)
+	params.Set("state", state)
+	authUrl.RawQuery = params.Encode()
+
+	self.Logger.Println("Start GET query:", authUrl.String())
+	resp, err := self.Client.Get(authUrl.String())
+	if err != nil {
+		return err
+	}
+	data, err := readPlusResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	self.Logger.Println("Finding login form..")
+	loginForm, err := parser.FindLoginForm(bytes.NewReader(data), nil)
+	if err != nil {
+		return err
+	}
+	actionURL := resp.Request.URL
+	if loginForm.ActionURL != nil {
+		actionURL = actionURL.ResolveReference(loginForm.ActionURL)
+	}
+	loginForm.FormValues.Set(CarunaPlusLoginFieldUsername, username)
+	loginForm.FormValues.Set(CarunaPlusLoginFieldPassword, password)
+
+	// Successful login redirects back to the redirect url with the authorization code
+	self.Logger.Println("Start POST query:", actionURL.String())
+	resp, err = self.Client.PostForm(actionURL.String(), *loginForm.FormValues)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	query := resp.Request.URL.Query()
+	code := query.Get("code")
+	if code == "" {
+		return fmt.Errorf("No authorization code received (http status %d). Wrong credentials?", resp.StatusCode)
+	}
+	if query.Get("state") != state {
+		return fmt.Errorf("Authorization state mismatch")
+	}
+
+	// Exchange the code for tokens
+	vals := url.Values{}
+	vals.Set("grant_type", "authorization_code")
+	vals.Set("code", code)
+	vals.Set("redirect_uri", self.RedirectUrl)
+	vals.Set("client_id", self.ClientId)
+	if err := self.requestToken(vals); err != nil {
+		return err
+	}
+
+	self.UserInfo, err = self.GetUserInfo()
+	if err != nil {
+		return fmt.Errorf("Could not get User Info: %v", err)
+	}
+	return nil
+}
+
+func (self *CarunaPlusClient) requestToken(vals url.Values) error {
+	tokenUrl := self.AuthUrl + CarunaPlusTokenUri
+	self.Logger.Println("Start token request:", tokenUrl, vals.Get("grant_type"))
+	resp, err := self.Client.PostForm(tokenUrl, vals)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	token := &PlusTokenResponse{}
+	if err := json.Unmarshal(data, token); err != nil {
+		return fmt.Errorf("Cannot parse token response (http status %d): %s", resp.StatusCode, err)
+	}
+	if token.Error != "" {
+		return fmt.Errorf("Token request failed: %s %s", token.Error, token.ErrorDesc)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return fmt.Errorf("Token request failed with http status %d", resp.StatusCode)
+	}
+
+	// Refresh responses are allowed to omit the refresh token
+	if token.RefreshToken == "" && self.token != nil {
+		token.RefreshToken = self.token.RefreshToken
+	}
+	self.token = token
+	self.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return nil
+}
+
+func (self *CarunaPlusClient) refreshToken() error {
+	if self.token == nil || self.token.RefreshToken == "" {
+		return fmt.Errorf("No refresh token available, re-authentication required")
+	}
+	vals := url.Values{}
+	vals.Set("grant_type", "refresh_token")
+	vals.Set("refresh_token", self.token.RefreshToken)
+	vals.Set("client_id", self.ClientId)
+	return self.requestToken(vals)
+}
+
+func (self *CarunaPlusClient) accessToken() (string, error) {
+	if self.token == nil {
+		return "", fmt.Errorf("Not authenticated")
+	}
+	if time.Now().Add(CarunaPlusTokenRefreshMargin).After(self.tokenExpiry) {
+		self.Logger.Println("Access token about to expire, refreshing..")
+		if err := self.refreshToken(); err != nil {
+			return "", err
+		}
+	}
+	return self.token.AccessToken, nil
+}
+
+func (self *CarunaPlusClient) getJson(path string, params url.Values, v interface{}) error {
+	reqUrl, err := url.Parse(self.ApiUrl + path)
+	if err != nil {
+		return err
+	}
+	if params != nil {
+		reqUrl.RawQuery = params.Encode()
+	}
+
+	var resp *http.Response
+	// Retry once with a refreshed token if the API rejects the current one
+	for try := 0; try < 2; try++ {
+		token, err := self.accessToken()
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("GET", reqUrl.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/json")
+
+		self.Logger.Println("Start GET query:", reqUrl.String())
+		resp, err = self.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || try > 0 {
+			break
+		}
+		resp.Body.Close()
+		if err := self.refreshToken(); err != nil {
+			return err
+		}
+	}
+
+	data, err := readPlusResponse(resp)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (self *CarunaPlusClient) GetUserInfo() (*PlusUserInfo, error) {
+	ret := &PlusUserInfo{}
+	if err := self.getJson(CarunaPlusApiUriCurrentUser, nil, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (self *CarunaPlusClient) customerNumbers() []string {
+	ret := make([]string, 0)
+	seen := make(map[string]bool)
+	all := append(append([]string{}, self.UserInfo.OwnCustomerNumbers...), self.UserInfo.RepresentedCustomerNumbers...)
+	for _, c := range all {
+		if !seen[c] {
+			seen[c] = true
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+func (self *CarunaPlusClient) GetMeteringPoints() ([]MeteringPoint, error) {
+	ret := make([]MeteringPoint, 0)
+	assets := make(map[string]plusAssetRef)
+
+	for _, customer := range self.customerNumbers() {
+		raw := make([]PlusAsset, 0)
+		err := self.getJson(fmt.Sprintf(CarunaPlusApiUriAssets, url.QueryEscape(customer)), nil, &raw)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot parse Caruna Plus assets: %s", err)
+		}
+		for _, a := range raw {
+			mp := MeteringPoint{
+				Created:             a.ActiveFrom,
+				Deleted:             a.ActiveTo,
+				MeteringPointNumber: a.MeteringPointNumber,
+				MeteringPointType:   a.Type,
+				HourlyMeasured:      a.HourlyMeasured,
+				Location:            []string{"", "", ""},
+			}
+			if a.Address != nil {
+				street := strings.TrimSpace(strings.Join([]string{
+					a.Address.StreetName,
+					a.Address.HouseNumber,
+					a.Address.Stairwell,
+					a.Address.Apartment,
+				}, " "))
+				mp.Location = []string{
+					strings.Join(strings.Fields(street), " "),
+					a.Address.PostalCode,
+					a.Address.PostOffice,
+				}
+			}
+			assets[a.MeteringPointNumber] = plusAssetRef{customer: customer, assetId: a.AssetId}
+			ret = append(ret, mp)
+		}
+	}
+	self.assets = assets
+	return ret, nil
+}
+
+func (self *CarunaPlusClient) GetHourlySeries(meteringPointStr string, timeStart, timeStop time.Time) ([]HourlyEnergyMeasurement, error) {
+	if !timeStart.Before(timeStop) {
+		return nil, fmt.Errorf("timeStart is after timeStop")
+	}
+
+	ret := make([]HourlyEnergyMeasurement, 0)
+
+	meteringPoints, err := self.GetMeteringPoints()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get metering points: %s", err)
+	}
+
+	for _, e := range meteringPoints {
+		if !MatchMeteringPoint(e, meteringPointStr) {
+			self.Logger.Println("Skipping meteringpoint:", e.MeteringPointNumber)
+			continue
+		}
+
+		hms, err := self.GetMeteringPointSeries(e, timeStart, timeStop)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, hms...)
+	}
+	return ret, nil
+}
+
+func (self *CarunaPlusClient) GetMeteringPointSeries(mp MeteringPoint, timeStart, timeStop time.Time) ([]HourlyEnergyMeasurement, error) {
+	if self.assets == nil {
+		if _, err := self.GetMeteringPoints(); err != nil {
+			return nil, err
+		}
+	}
+	ref, ok := self.assets[mp.MeteringPointNumber]
+	if !ok {
+		return nil, fmt.Errorf("Unknown metering point: %s", mp.MeteringPointNumber)
+	}
+
+	ret := make([]HourlyEnergyMeasurement, 0)
+	path := fmt.Sprintf(CarunaPlusApiUriEnergy, url.QueryEscape(ref.customer), url.QueryEscape(ref.assetId))
+
+	// The API serves one calendar day at a time
+	start := timeStart.In(self.location)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, self.location)
+	for ; day.Before(timeStop); day = day.AddDate(0, 0, 1) {
+		params := url.Values{}
+		params.Set(CarunaPlusApiEnergyQueryParamTimespan, CarunaPlusApiEnergyQueryParamTimespanValue)
+		params.Set(CarunaPlusApiEnergyQueryParamYear, strconv.Itoa(day.Year()))
+		params.Set(CarunaPlusApiEnergyQueryParamMonth, strconv.Itoa(int(day.Month())))
+		params.Set(CarunaPlusApiEnergyQueryParamDay, strconv.Itoa(day.Day()))
+
+		raw := make([]PlusEnergyValue, 0)
+		if err := self.getJson(path, params, &raw); err != nil {
+			return nil, err
+		}
+
+		for _, v := range raw {
+			// Skip missing values
+			if v.TotalConsumption == nil {
+				continue
+			}
+			ts, err := time.Parse(time.RFC3339, v.Timestamp)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't parse measurement timestamp: %s", err)
+			}
+			if ts.Before(timeStart) || !ts.Before(timeStop) {
+				continue
+			}
+			ret = append(ret, HourlyEnergyMeasurement{
+				Timestamp:             ts.UTC(),
+				MeteringPointId:       mp.MeteringPointNumber,
+				MeteringPointLocation: mp.Location,
+				Value:                 *v.TotalConsumption,
+				Status:                v.Status,
+			})
+		}
+	}
+	return ret, nil
+}
+
+func (self *CarunaPlusClient) Customer() string {
+	if self.UserInfo == nil {
+		return ""
+	}
+	return strings.Join(self.customerNumbers(), ",")
+}
+
+// Caruna Plus has no server side session to terminate, just forget the tokens
+func (self *CarunaPlusClient) Logout() error {
+	self.token = nil
+	self.assets = nil
+	return nil
+}
+
+func (self *CarunaPlusClient) SetLogger(logger *log.Logger) {
+	self.Logger = logger
+	self.Logger.SetPrefix("[CarunaPlusClient] ")
+}
+
+func NewCarunaPlusClient(username, password string, opts *PlusClientOpts) (*CarunaPlusClient, error) {
+	client := &CarunaPlusClient{
+		AuthUrl:     opts.AuthUrl,
+		ApiUrl:      opts.ApiUrl,
+		ClientId:    opts.ClientId,
+		RedirectUrl: opts.RedirectUrl,
+	}
+	if client.AuthUrl == "" {
+		client.AuthUrl = CarunaPlusAuthBase
+	}
+	if client.ApiUrl == "" {
+		client.ApiUrl = CarunaPlusBase
+	}
+	if client.ClientId == "" {
+		client.ClientId = CarunaPlusClientId
+	}
+	if client.RedirectUrl == "" {
+		client.RedirectUrl = client.ApiUrl + "/"
+	}
+	client.AuthUrl = strings.TrimSuffix(client.AuthUrl, "/")
+	client.ApiUrl = strings.TrimSuffix(client.ApiUrl, "/")
+
+	if opts.Logger == nil {
+		client.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	} else {
+		client.SetLogger(opts.Logger)
+	}
+
+	var err error
+	client.location, err = time.LoadLocation(CarunaPlusTimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client.Client = &http.Client{
+		Jar: jar,
+	}
+
+	if err := client.Authenticate(username, password); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func readPlusResponse(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Non-ok http status: %s %s", resp.Status, resp.Request.URL)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
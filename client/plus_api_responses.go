@@ -0,0 +1,43 @@
+package caruna
+
+type PlusTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IdToken      string `json:"id_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+type PlusUserInfo struct {
+	Username                   string   `json:"username"`
+	Email                      string   `json:"email"`
+	OwnCustomerNumbers         []string `json:"ownCustomerNumbers"`
+	RepresentedCustomerNumbers []string `json:"representedCustomerNumbers"`
+}
+
+type PlusAsset struct {
+	AssetId             string       `json:"assetId"`
+	MeteringPointNumber string       `json:"meteringPointNumber"`
+	Type                string       `json:"type"`
+	HourlyMeasured      bool         `json:"hourlyMeasured"`
+	ActiveFrom          string       `json:"activeFrom"`
+	ActiveTo            string       `json:"activeTo"`
+	Address             *PlusAddress `json:"address"`
+}
+
+type PlusAddress struct {
+	StreetName  string `json:"streetName"`
+	HouseNumber string `json:"houseNumber"`
+	Stairwell   string `json:"stairwell"`
+	Apartment   string `json:"apartment"`
+	PostalCode  string `json:"postalCode"`
+	PostOffice  string `json:"postOffice"`
+}
+
+type PlusEnergyValue struct {
+	Timestamp        string   `json:"timestamp"`
+	TotalConsumption *float64 `json:"totalConsumption"`
+	Status           string   `json:"status"`
+}
@@ -0,0 +1,366 @@
+package caruna
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// plusStub serves both the authorization server and the API
+type plusStub struct {
+	*httptest.Server
+	valid     map[string]bool // access tokens the API accepts
+	issued    int
+	refreshes int
+	rejected  int      // API requests answered with 401
+	days      []string // requested energy days as year-month-day
+}
+
+func newPlusStub(t *testing.T) *plusStub {
+	stub := &plusStub{valid: make(map[string]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(CarunaPlusAuthorizeUri, stub.authorize)
+	mux.HandleFunc("/login", stub.login)
+	mux.HandleFunc(CarunaPlusTokenUri, stub.token)
+	mux.HandleFunc(CarunaPlusApiUriCurrentUser, stub.api(`{"username":"user","ownCustomerNumbers":["c1"]}`))
+	mux.HandleFunc("/api/customers/c1/assets", stub.api(`[{"assetId":"a1","meteringPointNumber":"mp1","hourlyMeasured":true,
+		"address":{"streetName":"Katu","houseNumber":"1","postalCode":"00100","postOffice":"Helsinki"}}]`))
+	mux.HandleFunc("/api/customers/c1/assets/a1/energy", stub.energy)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Redirect target after login
+		fmt.Fprintln(w, "ok")
+	})
+	stub.Server = httptest.NewServer(mux)
+	return stub
+}
+
+func (self *plusStub) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != CarunaPlusClientId {
+		http.Error(w, "bad authorize request", http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, `<html><body><form action="/login" method="post">
+<input type="hidden" name="state" value="%s">
+<input type="hidden" name="redirect_uri" value="%s">
+<input type="text" name="username"><input type="password" name="password">
+</form></body></html>`, q.Get("state"), q.Get("redirect_uri"))
+}
+
+func (self *plusStub) login(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("username") != "user" || r.Form.Get("password") != "secret" {
+		fmt.Fprintln(w, "<html><body>Wrong credentials</body></html>")
+		return
+	}
+	redirect := r.Form.Get("redirect_uri") + "?" + url.Values{
+		"code":  {"authcode"},
+		"state": {r.Form.Get("state")},
+	}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (self *plusStub) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	resp := map[string]interface{}{"token_type": "Bearer", "expires_in": 3600}
+	switch r.Form.Get("grant_type") {
+	case "authorization_code":
+		if r.Form.Get("code") != "authcode" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		resp["refresh_token"] = "refresh1"
+	case "refresh_token":
+		if r.Form.Get("refresh_token") != "refresh1" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		// Refresh responses omit the refresh token
+		self.refreshes++
+	default:
+		http.Error(w, "bad grant", http.StatusBadRequest)
+		return
+	}
+	self.issued++
+	token := fmt.Sprintf("access%d", self.issued)
+	self.valid[token] = true
+	resp["access_token"] = token
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (self *plusStub) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !self.valid[token] {
+		self.rejected++
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (self *plusStub) api(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if self.authorized(w, r) {
+			fmt.Fprint(w, body)
+		}
+	}
+}
+
+// energy serves every hour of the requested Helsinki day, the value is the
+// hour index within the day and the 12th hour is missing
+func (self *plusStub) energy(w http.ResponseWriter, r *http.Request) {
+	if !self.authorized(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	year, _ := strconv.Atoi(q.Get("year"))
+	month, _ := strconv.Atoi(q.Get("month"))
+	day, _ := strconv.Atoi(q.Get("day"))
+	if q.Get("timespan") != "daily" || year == 0 || month == 0 || day == 0 {
+		http.Error(w, "bad energy request", http.StatusBadRequest)
+		return
+	}
+	self.days = append(self.days, fmt.Sprintf("%d-%d-%d", year, month, day))
+
+	loc, _ := time.LoadLocation(CarunaPlusTimeZone)
+	start := time.Date(year, time.Month(month), day, 0, 0, 0, 0, loc)
+	stop := start.AddDate(0, 0, 1)
+	values := make([]map[string]interface{}, 0)
+	for i, ts := 0, start; ts.Before(stop); i, ts = i+1, ts.Add(time.Hour) {
+		v := map[string]interface{}{"timestamp": ts.Format(time.RFC3339), "status": "OK"}
+		if i == 12 {
+			v["totalConsumption"] = nil
+		} else {
+			v["totalConsumption"] = float64(i)
+		}
+		values = append(values, v)
+	}
+	json.NewEncoder(w).Encode(values)
+}
+
+func (self *plusStub) revokeAll() {
+	self.valid = make(map[string]bool)
+}
+
+func newStubPlusClient(stub *plusStub, password string) (*CarunaPlusClient, error) {
+	return NewCarunaPlusClient("user", password, &PlusClientOpts{
+		AuthUrl: stub.URL,
+		ApiUrl:  stub.URL,
+	})
+}
+
+func TestPlusAuthenticate(t *testing.T) {
+	stub := newPlusStub(t)
+	defer stub.Close()
+
+	client, err := newStubPlusClient(stub, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Customer() != "c1" {
+		t.Errorf("Customer() = %q, want c1", client.Customer())
+	}
+	mps, err := client.GetMeteringPoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mps) != 1 || mps[0].MeteringPointNumber != "mp1" {
+		t.Fatalf("unexpected metering points: %+v", mps)
+	}
+	if want := []string{"Katu 1", "00100", "Helsinki"}; strings.Join(mps[0].Location, "|") != strings.Join(want, "|") {
+		t.Errorf("Location = %v, want %v", mps[0].Location, want)
+	}
+}
+
+func TestPlusWrongCredentials(t *testing.T) {
+	stub := newPlusStub(t)
+	defer stub.Close()
+
+	_, err := newStubPlusClient(stub, "wrong")
+	if err == nil || !strings.Contains(err.Error(), "No authorization code") {
+		t.Fatalf("expected missing authorization code error, got %v", err)
+	}
+}
+
+func TestPlusRefreshOnUnauthorized(t *testing.T) {
+	stub := newPlusStub(t)
+	defer stub.Close()
+
+	client, err := newStubPlusClient(stub, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The API rejects the current token, the client refreshes and retries
+	stub.revokeAll()
+	if _, err := client.GetMeteringPoints(); err != nil {
+		t.Fatal(err)
+	}
+	if stub.refreshes != 1 {
+		t.Fatalf("refreshes = %d, want 1", stub.refreshes)
+	}
+	if client.token.AccessToken != "access2" {
+		t.Errorf("access token = %q, want access2", client.token.AccessToken)
+	}
+
+	// The refresh response omitted the refresh token, the old one must be kept
+	if client.token.RefreshToken != "refresh1" {
+		t.Fatalf("refresh token = %q, want refresh1", client.token.RefreshToken)
+	}
+	stub.revokeAll()
+	if _, err := client.GetUserInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if stub.refreshes != 2 {
+		t.Fatalf("refreshes = %d, want 2", stub.refreshes)
+	}
+}
+
+func TestPlusUnauthorizedAfterRefresh(t *testing.T) {
+	stub := newPlusStub(t)
+	defer stub.Close()
+
+	client, err := newStubPlusClient(stub, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one retry is made
+	handler := stub.Config.Handler
+	stub.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	if _, err := client.GetUserInfo(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if stub.refreshes != 1 {
+		t.Fatalf("refreshes = %d, want 1", stub.refreshes)
+	}
+}
+
+func TestPlusMeteringPointSeries(t *testing.T) {
+	stub := newPlusStub(t)
+	defer stub.Close()
+
+	client, err := newStubPlusClient(stub, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mps, err := client.GetMeteringPoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Local days 2024-10-27 (25 hours) and 2024-10-28
+	start := time.Date(2024, 10, 26, 21, 0, 0, 0, time.UTC)
+	stop := time.Date(2024, 10, 28, 22, 0, 0, 0, time.UTC)
+	hms, err := client.GetMeteringPointSeries(mps[0], start, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(stub.days, ","); got != "2024-10-27,2024-10-28" {
+		t.Errorf("requested days %s", got)
+	}
+	// The missing 12th hour of both days is skipped
+	if len(hms) != 25+24-2 {
+		t.Fatalf("expected 47 measurements, got %d", len(hms))
+	}
+	if !hms[0].Timestamp.Equal(start) || hms[0].Timestamp.Location() != time.UTC {
+		t.Errorf("first timestamp %s, want %s", hms[0].Timestamp, start)
+	}
+	if last := hms[len(hms)-1].Timestamp; !last.Equal(stop.Add(-time.Hour)) {
+		t.Errorf("last timestamp %s, want %s", last, stop.Add(-time.Hour))
+	}
+	// The repeated 03 hour is two distinct hours, the next day starts from 0
+	for i := 1; i < len(hms); i++ {
+		if !hms[i].Timestamp.After(hms[i-1].Timestamp) {
+			t.Fatalf("timestamps not increasing at %d: %s, %s", i, hms[i-1].Timestamp, hms[i].Timestamp)
+		}
+	}
+	if hms[23].Value != 24 || hms[24].Value != 0 {
+		t.Errorf("expected the day to change after 25 hours, got %v, %v", hms[23].Value, hms[24].Value)
+	}
+	if hms[0].MeteringPointId != "mp1" || hms[0].Status != "OK" {
+		t.Errorf("unexpected measurement %+v", hms[0])
+	}
+}
+
+func TestPlusMeteringPointSeriesPartialDays(t *testing.T) {
+	stub := newPlusStub(t)
+	defer stub.Close()
+
+	client, err := newStubPlusClient(stub, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mps, err := client.GetMeteringPoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// From 2024-03-31 02:00 to 2024-04-01 03:00 local, the 31st has 23 hours
+	start := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	stop := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	hms, err := client.GetMeteringPointSeries(mps[0], start, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(stub.days, ","); got != "2024-3-31,2024-4-1" {
+		t.Errorf("requested days %s", got)
+	}
+	// Hours 2-22 of the 31st and 0-2 of the 1st, minus the missing 12th
+	if len(hms) != 21+3-1 {
+		t.Fatalf("expected 23 measurements, got %d", len(hms))
+	}
+	if !hms[0].Timestamp.Equal(start) || hms[0].Value != 2 {
+		t.Errorf("first measurement %s %v, want %s 2", hms[0].Timestamp, hms[0].Value, start)
+	}
+	if last := hms[len(hms)-1]; !last.Timestamp.Equal(stop.Add(-time.Hour)) || last.Value != 2 {
+		t.Errorf("last measurement %s %v, want %s 2", last.Timestamp, last.Value, stop.Add(-time.Hour))
+	}
+}
+
+func TestPlusRefreshNearExpiry(t *testing.T) {
+	stub := newPlusStub(t)
+	defer stub.Close()
+
+	client, err := newStubPlusClient(stub, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token well before expiry is used as is
+	if _, err := client.GetMeteringPoints(); err != nil {
+		t.Fatal(err)
+	}
+	if stub.refreshes != 0 {
+		t.Fatalf("refreshes = %d, want 0", stub.refreshes)
+	}
+
+	// Within the margin the token is refreshed before the request
+	client.tokenExpiry = time.Now().Add(CarunaPlusTokenRefreshMargin / 2)
+	if _, err := client.GetUserInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if stub.refreshes != 1 || stub.rejected != 0 {
+		t.Fatalf("refreshes = %d, rejected = %d, want 1 and 0", stub.refreshes, stub.rejected)
+	}
+	if client.token.AccessToken != "access2" {
+		t.Errorf("access token = %q, want access2", client.token.AccessToken)
+	}
+	if !client.tokenExpiry.After(time.Now().Add(time.Hour - time.Minute)) {
+		t.Errorf("token expiry not extended: %s", client.tokenExpiry)
+	}
+}
@@ -0,0 +1,26 @@
+package caruna
+
+import (
+	"strings"
+	"time"
+)
+
+// DataSource is implemented by everything that can provide metering points
+// and hourly measurements, for example the legacy and the Caruna Plus clients
+type DataSource interface {
+	GetMeteringPoints() ([]MeteringPoint, error)
+	GetHourlySeries(meteringPointStr string, timeStart, timeStop time.Time) ([]HourlyEnergyMeasurement, error)
+	GetMeteringPointSeries(mp MeteringPoint, timeStart, timeStop time.Time) ([]HourlyEnergyMeasurement, error)
+	// Customer identifies the account the data belongs to, empty if unknown
+	Customer() string
+	Logout() error
+}
+
+// MatchMeteringPoint evaluates user specified metering point filter. Empty filter matches everything.
+func MatchMeteringPoint(mp MeteringPoint, meteringPointStr string) bool {
+	if meteringPointStr == "" {
+		return true
+	}
+	return mp.MeteringPointNumber == meteringPointStr ||
+		strings.Contains(strings.Join(mp.Location, " "), meteringPointStr)
+}
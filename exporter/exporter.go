@@ -0,0 +1,236 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+	"github.com/aakso/gcaruna/output"
+)
+
+type Config struct {
+	Listen   string
+	Interval time.Duration
+	// How far back each refresh fetches
+	Window time.Duration
+}
+
+// Exporter serves Prometheus metrics from data that is refreshed on a schedule, so
+// that scrapes never trigger a Caruna login
+type Exporter struct {
+	logger *log.Logger
+	config *Config
+	login  func() (caruna.DataSource, error)
+
+	mu              sync.Mutex
+	points          map[string]*pointState
+	refreshed       bool
+	refreshSuccess  bool
+	refreshDuration time.Duration
+	refreshTime     time.Time
+	refreshErrors   int
+	loginSuccess    bool
+	loginDuration   time.Duration
+}
+
+type pointState struct {
+	labels []output.PromLabel
+	latest caruna.HourlyEnergyMeasurement
+	// Sum of all hours seen up to and including counted
+	total   float64
+	counted time.Time
+}
+
+func (self *Exporter) SetLogger(logger *log.Logger) {
+	self.logger = logger
+	self.logger.SetPrefix("[Exporter] ")
+}
+
+// Run refreshes in the background and serves /metrics until the server fails
+func (self *Exporter) Run() error {
+	go self.refreshLoop(nil)
+	self.logger.Printf("Listening on %s", self.config.Listen)
+	return http.ListenAndServe(self.config.Listen, self.Handler())
+}
+
+// refreshLoop refreshes every Interval until stop is closed
+func (self *Exporter) refreshLoop(stop <-chan struct{}) {
+	for {
+		if err := self.Refresh(); err != nil {
+			self.logger.Printf("Refresh failed: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(self.config.Interval):
+		}
+	}
+}
+
+// Handler serves /metrics and a landing page
+func (self *Exporter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", self)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, `<html><body><a href="/metrics">Metrics</a></body></html>`)
+	})
+	return mux
+}
+
+// Refresh logs in and fetches the latest data for all metering points
+func (self *Exporter) Refresh() error {
+	start := time.Now()
+	source, err := self.login()
+	loginDuration := time.Since(start)
+
+	self.mu.Lock()
+	self.loginSuccess = err == nil
+	self.loginDuration = loginDuration
+	self.mu.Unlock()
+	if err != nil {
+		self.refreshDone(start, false)
+		return fmt.Errorf("Cannot login: %s", err)
+	}
+	defer source.Logout()
+
+	mps, err := source.GetMeteringPoints()
+	if err != nil {
+		self.refreshDone(start, false)
+		return fmt.Errorf("Cannot get metering points: %s", err)
+	}
+	stop := time.Now().UTC()
+	series := make(map[string][]caruna.HourlyEnergyMeasurement)
+	for _, mp := range mps {
+		hms, err := source.GetMeteringPointSeries(mp, stop.Add(-self.config.Window), stop)
+		if err != nil {
+			self.refreshDone(start, false)
+			return fmt.Errorf("Cannot get series for %s: %s", mp.MeteringPointNumber, err)
+		}
+		series[mp.MeteringPointNumber] = hms
+	}
+
+	self.mu.Lock()
+	for _, mp := range mps {
+		hms := series[mp.MeteringPointNumber]
+		if len(hms) == 0 {
+			continue
+		}
+		sort.Sort(byTime(hms))
+		p, ok := self.points[mp.MeteringPointNumber]
+		if !ok {
+			p = &pointState{}
+			self.points[mp.MeteringPointNumber] = p
+		}
+		p.labels = output.PromLabels(mp.MeteringPointNumber, mp.Location, mp.MeteringPointType)
+		for _, e := range hms {
+			if e.Timestamp.After(p.counted) {
+				p.total += e.Value
+				p.counted = e.Timestamp
+			}
+		}
+		p.latest = hms[len(hms)-1]
+	}
+	self.mu.Unlock()
+	self.refreshDone(start, true)
+	self.logger.Printf("Refreshed %d metering points in %s", len(mps), time.Since(start))
+	return nil
+}
+
+func (self *Exporter) refreshDone(start time.Time, success bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.refreshed = true
+	self.refreshSuccess = success
+	self.refreshDuration = time.Since(start)
+	self.refreshTime = time.Now()
+	if !success {
+		self.refreshErrors++
+	}
+}
+
+func (self *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	self.writeMetrics(&buf, time.Now())
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (self *Exporter) writeMetrics(buf *bytes.Buffer, now time.Time) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	ids := make([]string, 0, len(self.points))
+	for id := range self.points {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	perPoint := func(name, typ, help string, value func(p *pointState) float64) {
+		header(buf, name, typ, help)
+		for _, id := range ids {
+			p := self.points[id]
+			fmt.Fprintf(buf, "%s %s\n", output.PromSeries(name, p.labels), output.PromValue(value(p)))
+		}
+	}
+	perPoint(output.MetricConsumption, "gauge", "Consumption of the newest available hour",
+		func(p *pointState) float64 { return p.latest.Value })
+	perPoint("gcaruna_consumption_timestamp_seconds", "gauge", "Start of the newest available hour",
+		func(p *pointState) float64 { return float64(p.latest.Timestamp.Unix()) })
+	perPoint(output.MetricEnergy+"_total", "counter", "Energy consumed in the hours seen since the exporter started",
+		func(p *pointState) float64 { return p.total })
+	perPoint("gcaruna_data_age_seconds", "gauge", "Time since the end of the newest available hour",
+		func(p *pointState) float64 { return now.Sub(p.latest.Timestamp.Add(time.Hour)).Seconds() })
+
+	if !self.refreshed {
+		return
+	}
+	metric(buf, "gcaruna_refresh_success", "gauge", "Whether the last refresh succeeded", boolValue(self.refreshSuccess))
+	metric(buf, "gcaruna_refresh_duration_seconds", "gauge", "Duration of the last refresh", self.refreshDuration.Seconds())
+	metric(buf, "gcaruna_refresh_timestamp_seconds", "gauge", "Time of the last refresh", float64(self.refreshTime.Unix()))
+	metric(buf, "gcaruna_refresh_errors_total", "counter", "Number of failed refreshes", float64(self.refreshErrors))
+	metric(buf, "gcaruna_login_success", "gauge", "Whether the last login succeeded", boolValue(self.loginSuccess))
+	metric(buf, "gcaruna_login_duration_seconds", "gauge", "Duration of the last login", self.loginDuration.Seconds())
+}
+
+func header(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func metric(buf *bytes.Buffer, name, typ, help string, value float64) {
+	header(buf, name, typ, help)
+	fmt.Fprintf(buf, "%s %s\n", name, output.PromValue(value))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type byTime []caruna.HourlyEnergyMeasurement
+
+func (s byTime) Len() int           { return len(s) }
+func (s byTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTime) Less(i, j int) bool { return s[i].Timestamp.Before(s[j].Timestamp) }
+
+// NewExporter creates an exporter, login is called on every refresh
+func NewExporter(config *Config, login func() (caruna.DataSource, error)) *Exporter {
+	ret := &Exporter{
+		config: config,
+		login:  login,
+		points: make(map[string]*pointState),
+	}
+	ret.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	return ret
+}
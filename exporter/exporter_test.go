@@ -0,0 +1,158 @@
+package exporter
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+// fakeSource serves two hours ending at latest
+type fakeSource struct {
+	latest time.Time
+}
+
+func (self *fakeSource) GetMeteringPoints() ([]caruna.MeteringPoint, error) {
+	return []caruna.MeteringPoint{{MeteringPointNumber: "mp1", Location: []string{"Katu 1"}}}, nil
+}
+
+func (self *fakeSource) GetHourlySeries(meteringPointStr string, timeStart, timeStop time.Time) ([]caruna.HourlyEnergyMeasurement, error) {
+	return nil, nil
+}
+
+func (self *fakeSource) GetMeteringPointSeries(mp caruna.MeteringPoint, timeStart, timeStop time.Time) ([]caruna.HourlyEnergyMeasurement, error) {
+	return []caruna.HourlyEnergyMeasurement{
+		{MeteringPointId: "mp1", Timestamp: self.latest, Value: 0.5},
+		{MeteringPointId: "mp1", Timestamp: self.latest.Add(-time.Hour), Value: 0.25},
+	}, nil
+}
+
+func (self *fakeSource) Customer() string { return "" }
+func (self *fakeSource) Logout() error    { return nil }
+
+// logins counts login calls and fails them while failing is set
+type logins struct {
+	sync.Mutex
+	count   int
+	failing bool
+	latest  time.Time
+}
+
+func (self *logins) login() (caruna.DataSource, error) {
+	self.Lock()
+	defer self.Unlock()
+	self.count++
+	if self.failing {
+		return nil, errors.New("wrong credentials")
+	}
+	return &fakeSource{latest: self.latest}, nil
+}
+
+func (self *logins) calls() int {
+	self.Lock()
+	defer self.Unlock()
+	return self.count
+}
+
+// scrape returns the metric values of /metrics by series
+func scrape(t *testing.T, url string) map[string]float64 {
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make(map[string]float64)
+	for _, line := range strings.Split(string(body), "\n") {
+		i := strings.LastIndex(line, " ")
+		if line == "" || strings.HasPrefix(line, "#") || i == -1 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad sample %q: %s", line, err)
+		}
+		ret[line[:i]] = v
+	}
+	return ret
+}
+
+const mp1Labels = `{metering_point="mp1",address="Katu 1"}`
+
+func TestScrapeDoesNotRefresh(t *testing.T) {
+	l := &logins{latest: time.Now().Truncate(time.Hour).Add(-2 * time.Hour)}
+	exp := NewExporter(&Config{Interval: time.Hour, Window: 48 * time.Hour}, l.login)
+	server := httptest.NewServer(exp.Handler())
+	defer server.Close()
+
+	// Nothing is fetched before the first refresh
+	if m := scrape(t, server.URL); len(m) != 0 || l.calls() != 0 {
+		t.Fatalf("expected no metrics and no logins, got %v, %d logins", m, l.calls())
+	}
+	if err := exp.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		scrape(t, server.URL)
+	}
+	if l.calls() != 1 {
+		t.Errorf("expected 1 login, got %d", l.calls())
+	}
+
+	m := scrape(t, server.URL)
+	if v := m["gcaruna_consumption_kwh"+mp1Labels]; v != 0.5 {
+		t.Errorf("expected consumption 0.5, got %v", v)
+	}
+	if v := m["gcaruna_energy_kwh_total"+mp1Labels]; v != 0.75 {
+		t.Errorf("expected energy 0.75, got %v", v)
+	}
+	// The newest hour ended over an hour ago
+	if v := m["gcaruna_data_age_seconds"+mp1Labels]; v < 3600 || v > 2*3600 {
+		t.Errorf("unexpected data age %v", v)
+	}
+	if m["gcaruna_login_success"] != 1 || m["gcaruna_refresh_success"] != 1 || m["gcaruna_refresh_errors_total"] != 0 {
+		t.Errorf("unexpected status metrics: %v", m)
+	}
+
+	// A failed login keeps the previous data
+	l.failing = true
+	if err := exp.Refresh(); err == nil {
+		t.Fatal("expected a login error")
+	}
+	m = scrape(t, server.URL)
+	if m["gcaruna_login_success"] != 0 || m["gcaruna_refresh_success"] != 0 || m["gcaruna_refresh_errors_total"] != 1 {
+		t.Errorf("unexpected status metrics after a failed login: %v", m)
+	}
+	if v := m["gcaruna_consumption_kwh"+mp1Labels]; v != 0.5 {
+		t.Errorf("expected consumption 0.5 to be kept, got %v", v)
+	}
+}
+
+func TestRefreshSchedule(t *testing.T) {
+	l := &logins{latest: time.Now().Truncate(time.Hour).Add(-2 * time.Hour)}
+	exp := NewExporter(&Config{Interval: 20 * time.Millisecond, Window: 48 * time.Hour}, l.login)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		exp.refreshLoop(stop)
+		close(done)
+	}()
+
+	// The first refresh happens right away, then every interval
+	time.Sleep(70 * time.Millisecond)
+	close(stop)
+	<-done
+	if n := l.calls(); n < 2 || n > 5 {
+		t.Errorf("expected about 4 refreshes in 70ms, got %d", n)
+	}
+}
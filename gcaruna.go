@@ -9,37 +9,72 @@ import (
 	"time"
 
 	"github.com/aakso/gcaruna/client"
+	"github.com/aakso/gcaruna/exporter"
+	"github.com/aakso/gcaruna/input"
 	"github.com/aakso/gcaruna/output"
+	"github.com/aakso/gcaruna/reconcile"
+	"github.com/aakso/gcaruna/timerange"
 )
 
 type (
 	OperatingMode uint
-	OutputMode    uint
+	BackendMode   uint
 )
 
 const (
 	SeriesMode OperatingMode = iota
 	LocationMode
+	ReconcileMode
+	ServeMode
 
-	TextOutput OutputMode = iota
-	JsonOutput
-	InfluxDbOutput
+	LegacyBackend BackendMode = iota
+	PlusBackend
+	CsvBackend
+	DatahubBackend
 
-	EnvPrefix = "GCARUNA_"
+	EnvPrefix       = "GCARUNA_"
+	DefaultTimeZone = "Europe/Helsinki"
 )
 
 type Config struct {
 	TimeStart      time.Time
 	TimeStop       time.Time
+	TimeZone       *time.Location
 	Mode           OperatingMode
-	Output         OutputMode
+	Outputs        []output.Spec
+	Backend        BackendMode
 	CarunaUrl      string
+	PlusAuthUrl    string
+	PlusApiUrl     string
+	InputFiles     []string
 	CarunaUsername string
 	CarunaPassword string
 	Location       string
 	Debug          bool
+	// Datahub reconcile specific
+	DatahubFiles       []string
+	DatahubMap         map[string]string
+	ReconcileTolerance float64
 	// InfluxDB output specific
 	InfluxDB *output.InfluxDBConfig
+	// InfluxDB 2.x/3.x output specific
+	InfluxDB2 *output.InfluxDB2Config
+	// InfluxDB 0.8 output specific
+	InfluxDB08 *output.InfluxDB08Config
+	// Prometheus remote-write output specific
+	RemoteWrite *output.RemoteWriteConfig
+	// Spool for failed database writes
+	Spool *output.SpoolConfig
+	// Text output specific
+	Text *output.TextConfig
+	// CSV output specific
+	CSV *output.CSVConfig
+	// Chart output specific
+	Chart *output.ChartConfig
+	// Template output specific
+	Template *output.TemplateConfig
+	// Exporter specific
+	Exporter *exporter.Config
 	// Internal config parsing stuff
 	argmap map[string]interface{}
 	*flag.FlagSet
@@ -76,6 +111,12 @@ func (cfg *Config) mergeEnv() error {
 func (cfg *Config) Parse(args []string) error {
 	var err error
 
+	// The serve subcommand runs the Prometheus exporter
+	serve := len(args) > 0 && args[0] == "serve"
+	if serve {
+		args = args[1:]
+	}
+
 	// Parse flags
 	cfg.FlagSet.Parse(args)
 
@@ -91,50 +132,181 @@ func (cfg *Config) Parse(args []string) error {
 		cfg.Mode = SeriesMode
 	case "location":
 		cfg.Mode = LocationMode
+	case "reconcile":
+		cfg.Mode = ReconcileMode
 	default:
 		return fmt.Errorf("unknown operating mode")
 	}
+	if serve {
+		cfg.Mode = ServeMode
+	}
+
+	// Outputs, any registered output is accepted
+	cfg.Outputs, err = output.ParseSpecs(*cfg.argmap["output"].(*string))
+	if err != nil {
+		return err
+	}
 
-	// Output mode
-	switch *cfg.argmap["output"].(*string) {
-	case "text":
-		cfg.Output = TextOutput
-	case "json":
-		cfg.Output = JsonOutput
-	case "influxdb":
-		cfg.Output = InfluxDbOutput
+	// Backend
+	switch *cfg.argmap["backend"].(*string) {
+	case "legacy":
+		cfg.Backend = LegacyBackend
+	case "plus":
+		cfg.Backend = PlusBackend
+	case "csv":
+		cfg.Backend = CsvBackend
+	case "datahub":
+		cfg.Backend = DatahubBackend
 	default:
-		return fmt.Errorf("unknown output mode")
+		return fmt.Errorf("unknown backend")
+	}
+
+	// Display zone, also used for timestamps without an offset
+	cfg.TimeZone, err = time.LoadLocation(*cfg.argmap["tz"].(*string))
+	if err != nil {
+		return fmt.Errorf("Cannot load time zone: %s", err)
 	}
 
-	// Parse timestamps
+	// Parse timestamps, internally everything is UTC
+	now := time.Now()
 	start := *cfg.argmap["tstart"].(*string)
 	if start != "" {
-		cfg.TimeStart, err = time.Parse(time.RFC3339, *cfg.argmap["tstart"].(*string))
+		cfg.TimeStart, err = timerange.ParseTime(start, now, cfg.TimeZone)
 		if err != nil {
 			return fmt.Errorf("Cannot parse time_start: %s", err)
 		}
 	} else {
-		cfg.TimeStart = time.Now().Add(-1 * *cfg.argmap["rel_tstart"].(*time.Duration))
+		cfg.TimeStart = now.Add(-1 * *cfg.argmap["rel_tstart"].(*time.Duration)).UTC()
 	}
 
-	cfg.TimeStop, err = time.Parse(time.RFC3339, *cfg.argmap["tstop"].(*string))
+	cfg.TimeStop, err = timerange.ParseTime(*cfg.argmap["tstop"].(*string), now, cfg.TimeZone)
 	if err != nil {
 		return fmt.Errorf("Cannot parse time_stop: %s", err)
 	}
 
+	// Range expression overrides start and stop
+	if expr := *cfg.argmap["trange"].(*string); expr != "" {
+		cfg.TimeStart, cfg.TimeStop, err = timerange.Parse(expr, now, cfg.TimeZone)
+		if err != nil {
+			return fmt.Errorf("Cannot parse range: %s", err)
+		}
+	}
+	if !cfg.TimeStart.Before(cfg.TimeStop) {
+		return fmt.Errorf("time_start is after time_stop")
+	}
+
 	cfg.Debug = *cfg.argmap["debug"].(*bool)
 	cfg.CarunaUrl = *cfg.argmap["caruna_url"].(*string)
 	cfg.CarunaUsername = *cfg.argmap["username"].(*string)
 	cfg.CarunaPassword = *cfg.argmap["password"].(*string)
 	cfg.CarunaUrl = *cfg.argmap["caruna_url"].(*string)
+	cfg.PlusAuthUrl = *cfg.argmap["plus_auth_url"].(*string)
+	cfg.PlusApiUrl = *cfg.argmap["plus_api_url"].(*string)
 	cfg.Location = *cfg.argmap["location"].(*string)
+	if inputs := *cfg.argmap["input"].(*string); inputs != "" {
+		cfg.InputFiles = strings.Split(inputs, ",")
+	}
+	if (cfg.Backend == CsvBackend || cfg.Backend == DatahubBackend) && len(cfg.InputFiles) == 0 {
+		return fmt.Errorf("file backends require -input")
+	}
+	if files := *cfg.argmap["datahub"].(*string); files != "" {
+		cfg.DatahubFiles = strings.Split(files, ",")
+	}
+	if cfg.Mode == ReconcileMode && len(cfg.DatahubFiles) == 0 {
+		return fmt.Errorf("reconcile mode requires -datahub")
+	}
+	cfg.DatahubMap = make(map[string]string)
+	if mapping := *cfg.argmap["datahub_map"].(*string); mapping != "" {
+		for _, pair := range strings.Split(mapping, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("Cannot parse datahub_map entry: %s", pair)
+			}
+			cfg.DatahubMap[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	cfg.ReconcileTolerance = *cfg.argmap["reconcile_tolerance"].(*float64)
 	cfg.InfluxDB = &output.InfluxDBConfig{}
 	cfg.InfluxDB.URL = *cfg.argmap["influxdb_url"].(*string)
 	cfg.InfluxDB.Username = *cfg.argmap["influxdb_username"].(*string)
 	cfg.InfluxDB.Password = *cfg.argmap["influxdb_password"].(*string)
 	cfg.InfluxDB.Database = *cfg.argmap["influxdb_database"].(*string)
 	cfg.InfluxDB.Incremental = *cfg.argmap["influxdb_incremental"].(*bool)
+	cfg.InfluxDB.Reconcile = *cfg.argmap["influxdb_reconcile"].(*bool)
+	cfg.InfluxDB.ReconcileWindow = *cfg.argmap["influxdb_reconcile_window"].(*time.Duration)
+	// Revisions can only be found in fetched hours, so fetch the whole window
+	// unless the range was given explicitly
+	if cfg.InfluxDB.Reconcile && start == "" && *cfg.argmap["trange"].(*string) == "" {
+		if windowStart := now.Add(-cfg.InfluxDB.ReconcileWindow).UTC(); windowStart.Before(cfg.TimeStart) {
+			cfg.TimeStart = windowStart
+		}
+	}
+	cfg.InfluxDB.BatchSize = *cfg.argmap["influxdb_batch_size"].(*int)
+	cfg.InfluxDB.Retries = *cfg.argmap["influxdb_retries"].(*int)
+	cfg.InfluxDB.RetryDelay = *cfg.argmap["influxdb_retry_delay"].(*time.Duration)
+	cfg.InfluxDB.RetentionPolicy = *cfg.argmap["influxdb_retention_policy"].(*string)
+	cfg.InfluxDB.CreateDatabase = *cfg.argmap["influxdb_create_database"].(*bool)
+	cfg.InfluxDB.Schema = output.DefaultInfluxSchema()
+	cfg.InfluxDB.Schema.Measurement = *cfg.argmap["influxdb_measurement"].(*string)
+	cfg.InfluxDB.Schema.PrimaryTag = *cfg.argmap["influxdb_tag"].(*string)
+	cfg.InfluxDB.Schema.DetailTags = *cfg.argmap["influxdb_detail_tags"].(*bool)
+	cfg.InfluxDB.Schema.Aliases, err = output.ParseKeyValues(*cfg.argmap["influxdb_aliases"].(*string))
+	if err != nil {
+		return fmt.Errorf("Cannot parse influxdb_aliases: %s", err)
+	}
+	cfg.InfluxDB.Schema.ExtraTags, err = output.ParseKeyValues(*cfg.argmap["influxdb_extra_tags"].(*string))
+	if err != nil {
+		return fmt.Errorf("Cannot parse influxdb_extra_tags: %s", err)
+	}
+	if err := cfg.InfluxDB.Schema.Validate(); err != nil {
+		return err
+	}
+	cfg.InfluxDB2 = &output.InfluxDB2Config{}
+	cfg.InfluxDB2.URL = *cfg.argmap["influxdb2_url"].(*string)
+	cfg.InfluxDB2.Token = *cfg.argmap["influxdb2_token"].(*string)
+	cfg.InfluxDB2.Org = *cfg.argmap["influxdb2_org"].(*string)
+	cfg.InfluxDB2.Bucket = *cfg.argmap["influxdb2_bucket"].(*string)
+	cfg.InfluxDB2.QueryLanguage = *cfg.argmap["influxdb2_query"].(*string)
+	cfg.InfluxDB2.Incremental = *cfg.argmap["influxdb2_incremental"].(*bool)
+	cfg.InfluxDB2.Schema = cfg.InfluxDB.Schema
+	cfg.InfluxDB08 = &output.InfluxDB08Config{}
+	cfg.InfluxDB08.Host = *cfg.argmap["influxdb08_host"].(*string)
+	cfg.InfluxDB08.Username = *cfg.argmap["influxdb08_username"].(*string)
+	cfg.InfluxDB08.Password = *cfg.argmap["influxdb08_password"].(*string)
+	cfg.InfluxDB08.Database = *cfg.argmap["influxdb08_database"].(*string)
+	cfg.InfluxDB08.IsSecure = *cfg.argmap["influxdb08_secure"].(*bool)
+	cfg.InfluxDB08.Incremental = *cfg.argmap["influxdb08_incremental"].(*bool)
+	cfg.InfluxDB08.Schema = cfg.InfluxDB.Schema
+	cfg.RemoteWrite = &output.RemoteWriteConfig{}
+	cfg.RemoteWrite.URL = *cfg.argmap["remote_write_url"].(*string)
+	cfg.RemoteWrite.Username = *cfg.argmap["remote_write_username"].(*string)
+	cfg.RemoteWrite.Password = *cfg.argmap["remote_write_password"].(*string)
+	cfg.RemoteWrite.BearerToken = *cfg.argmap["remote_write_token"].(*string)
+	cfg.RemoteWrite.Tenant = *cfg.argmap["remote_write_tenant"].(*string)
+	cfg.RemoteWrite.BatchSize = *cfg.argmap["remote_write_batch_size"].(*int)
+	cfg.Spool = &output.SpoolConfig{}
+	cfg.Spool.Dir = *cfg.argmap["spool_dir"].(*string)
+	cfg.Spool.MaxSize = *cfg.argmap["spool_max_size"].(*int64)
+	cfg.Exporter = &exporter.Config{}
+	cfg.Exporter.Listen = *cfg.argmap["listen"].(*string)
+	cfg.Exporter.Interval = *cfg.argmap["refresh_interval"].(*time.Duration)
+	cfg.Exporter.Window = *cfg.argmap["rel_tstart"].(*time.Duration)
+	if cfg.Exporter.Interval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive")
+	}
+	cfg.Text = &output.TextConfig{}
+	cfg.Text.Group = *cfg.argmap["group"].(*string)
+	cfg.CSV = &output.CSVConfig{}
+	cfg.CSV.Delimiter = *cfg.argmap["csv_delimiter"].(*string)
+	cfg.CSV.Decimal = *cfg.argmap["csv_decimal"].(*string)
+	cfg.CSV.Header = *cfg.argmap["csv_header"].(*bool)
+	cfg.CSV.Layout = *cfg.argmap["csv_layout"].(*string)
+	cfg.CSV.TimeLayout = *cfg.argmap["csv_time_layout"].(*string)
+	cfg.Chart = &output.ChartConfig{}
+	cfg.Chart.Width = *cfg.argmap["chart_width"].(*int)
+	cfg.Chart.ASCII = *cfg.argmap["chart_ascii"].(*bool)
+	cfg.Template = &output.TemplateConfig{}
+	cfg.Template.Path = *cfg.argmap["template"].(*string)
 	return nil
 }
 
@@ -157,19 +329,28 @@ func NewConfig() *Config {
 
 	// Defaults
 	rel_start := 48 * time.Hour
-	time_stop := time.Now().Format(time.RFC3339)
 	const (
-		mode   = "location"
-		output = "text"
+		mode    = "location"
+		outputs = "text"
+		backend = "legacy"
 	)
 
-	cfg.argmap["tstart"] = fs.String("start", "", "Start time in ISO8601 format")
-	cfg.argmap["tstop"] = fs.String("stop", time_stop, "Stop time in ISO8601 format")
+	cfg.argmap["tstart"] = fs.String("start", "", "Start time in ISO8601 format, local date or relative to now (7d or -7d ago, +1d ahead)")
+	cfg.argmap["tstop"] = fs.String("stop", "now", "Stop time in ISO8601 format, local date or relative to now (1d or -1d ago, +1d ahead)")
+	cfg.argmap["trange"] = fs.String("range", "", "Time range (today, yesterday, this-week, last-month, 2024-03, 2024, 2024-01-01..2024-02-15)")
+	cfg.argmap["tz"] = fs.String("tz", DefaultTimeZone, "Time zone for display and local dates")
 	cfg.argmap["rel_tstart"] = fs.Duration("rstart", rel_start, "Start time relative to now")
-	cfg.argmap["mode"] = fs.String("mode", mode, "Mode of operation (series, location)")
+	cfg.argmap["mode"] = fs.String("mode", mode, "Mode of operation (series, location, reconcile)")
 	cfg.argmap["location"] = fs.String("location", "", "Selected location for the series mode (address or location id)")
-	cfg.argmap["output"] = fs.String("output", output, "Output mode (text, json, influxdb)")
+	cfg.argmap["output"] = fs.String("output", outputs, "Comma separated list of outputs with optional target file, e.g. influxdb,json:/tmp/latest.json ("+strings.Join(output.Names(), ", ")+")")
+	cfg.argmap["backend"] = fs.String("backend", backend, "Caruna backend (legacy, plus, csv, datahub)")
+	cfg.argmap["input"] = fs.String("input", "", "Comma separated list of input files for the csv and datahub backends")
+	cfg.argmap["datahub"] = fs.String("datahub", "", "Comma separated list of Datahub exports for the reconcile mode")
+	cfg.argmap["datahub_map"] = fs.String("datahub_map", "", "Datahub GSRN to Caruna metering point mapping (gsrn=id,...)")
+	cfg.argmap["reconcile_tolerance"] = fs.Float64("reconcile_tolerance", 0.0005, "Largest difference in KWh that is not reported")
 	cfg.argmap["caruna_url"] = fs.String("url", caruna.CarunaAuthStart, "Caruna URL")
+	cfg.argmap["plus_auth_url"] = fs.String("plus_auth_url", caruna.CarunaPlusAuthBase, "Caruna Plus authorization server URL")
+	cfg.argmap["plus_api_url"] = fs.String("plus_api_url", caruna.CarunaPlusBase, "Caruna Plus API URL")
 	cfg.argmap["username"] = fs.String("username", "", "Caruna Username")
 	cfg.argmap["password"] = fs.String("password", "", "Caruna Password")
 	cfg.argmap["debug"] = fs.Bool("debug", false, "true/false")
@@ -178,9 +359,115 @@ func NewConfig() *Config {
 	cfg.argmap["influxdb_password"] = fs.String("influxdb_password", "", "InfluxDB password")
 	cfg.argmap["influxdb_database"] = fs.String("influxdb_database", "", "InfluxDB database name")
 	cfg.argmap["influxdb_incremental"] = fs.Bool("influxdb_incremental", true, "Whether to check firstval/lastval")
+	cfg.argmap["influxdb_reconcile"] = fs.Bool("influxdb_reconcile", false, "Rewrite stored values that Caruna has since revised. Values stored without a status are compared by value only")
+	cfg.argmap["influxdb_reconcile_window"] = fs.Duration("influxdb_reconcile_window", 30*24*time.Hour, "How far back -influxdb_reconcile compares stored values, extends -rstart unless -start or -range is given")
+	cfg.argmap["influxdb_batch_size"] = fs.Int("influxdb_batch_size", 5000, "Maximum number of points per InfluxDB write (0 for no limit)")
+	cfg.argmap["influxdb_retries"] = fs.Int("influxdb_retries", 3, "How many times a write that failed with a network error or 5xx status is retried")
+	cfg.argmap["influxdb_retry_delay"] = fs.Duration("influxdb_retry_delay", 2*time.Second, "Delay before the first retry, doubled after each attempt")
+	cfg.argmap["influxdb_retention_policy"] = fs.String("influxdb_retention_policy", "", "InfluxDB retention policy to write to")
+	cfg.argmap["influxdb_create_database"] = fs.Bool("influxdb_create_database", false, "Create the InfluxDB database if it doesn't exist")
+	cfg.argmap["influxdb_measurement"] = fs.String("influxdb_measurement", output.SeriesName, "InfluxDB measurement name")
+	cfg.argmap["influxdb_tag"] = fs.String("influxdb_tag", output.PrimaryTagAddress, "Value of the meteringpoint tag (address, id, alias)")
+	cfg.argmap["influxdb_aliases"] = fs.String("influxdb_aliases", "", "Metering point aliases for -influxdb_tag alias (id=alias,...)")
+	cfg.argmap["influxdb_detail_tags"] = fs.Bool("influxdb_detail_tags", false, "Add street, zip, city and type tags")
+	cfg.argmap["influxdb_extra_tags"] = fs.String("influxdb_extra_tags", "", "Static tags added to every point (site=hq,...)")
+	cfg.argmap["influxdb2_url"] = fs.String("influxdb2_url", "http://localhost:8086", "InfluxDB 2.x/3.x http url")
+	cfg.argmap["influxdb2_token"] = fs.String("influxdb2_token", "", "InfluxDB 2.x/3.x API token")
+	cfg.argmap["influxdb2_org"] = fs.String("influxdb2_org", "", "InfluxDB 2.x organization")
+	cfg.argmap["influxdb2_bucket"] = fs.String("influxdb2_bucket", "", "InfluxDB 2.x bucket or 3.x database")
+	cfg.argmap["influxdb2_query"] = fs.String("influxdb2_query", output.InfluxQueryFlux, "Query language for incremental checks (flux for 2.x, sql for 3.x)")
+	cfg.argmap["influxdb2_incremental"] = fs.Bool("influxdb2_incremental", true, "Whether to skip points that are already stored")
+	cfg.argmap["influxdb08_host"] = fs.String("influxdb08_host", "localhost:8086", "InfluxDB 0.8 host:port")
+	cfg.argmap["influxdb08_username"] = fs.String("influxdb08_username", "root", "InfluxDB 0.8 username")
+	cfg.argmap["influxdb08_password"] = fs.String("influxdb08_password", "root", "InfluxDB 0.8 password")
+	cfg.argmap["influxdb08_database"] = fs.String("influxdb08_database", "", "InfluxDB 0.8 database name")
+	cfg.argmap["influxdb08_secure"] = fs.Bool("influxdb08_secure", false, "Use https for InfluxDB 0.8")
+	cfg.argmap["influxdb08_incremental"] = fs.Bool("influxdb08_incremental", true, "Whether to check firstval/lastval")
+	cfg.argmap["remote_write_url"] = fs.String("remote_write_url", "", "Prometheus remote-write endpoint, e.g. http://mimir:9009/api/v1/push")
+	cfg.argmap["remote_write_username"] = fs.String("remote_write_username", "", "Remote-write basic auth username")
+	cfg.argmap["remote_write_password"] = fs.String("remote_write_password", "", "Remote-write basic auth password")
+	cfg.argmap["remote_write_token"] = fs.String("remote_write_token", "", "Remote-write bearer token")
+	cfg.argmap["remote_write_tenant"] = fs.String("remote_write_tenant", "", "Tenant sent as X-Scope-OrgID")
+	cfg.argmap["remote_write_batch_size"] = fs.Int("remote_write_batch_size", 5000, "Maximum number of samples per remote-write request (0 for no limit)")
+	cfg.argmap["spool_dir"] = fs.String("spool_dir", "", "Directory for spooling points that failed to write to an unreachable database, replayed on the next run")
+	cfg.argmap["spool_max_size"] = fs.Int64("spool_max_size", 64<<20, "Maximum size of a spool file in bytes")
+	cfg.argmap["listen"] = fs.String("listen", ":9588", "Listen address for the serve subcommand")
+	cfg.argmap["refresh_interval"] = fs.Duration("refresh_interval", time.Hour, "How often the serve subcommand fetches new data (-rstart sets how far back)")
+	cfg.argmap["group"] = fs.String("group", "", "Roll text output up by period (day, week, month)")
+	cfg.argmap["csv_delimiter"] = fs.String("csv_delimiter", ";", "CSV field delimiter (use \\t for tab)")
+	cfg.argmap["csv_decimal"] = fs.String("csv_decimal", ",", "CSV decimal separator (. or ,)")
+	cfg.argmap["csv_header"] = fs.Bool("csv_header", true, "Whether to write a CSV header row")
+	cfg.argmap["csv_layout"] = fs.String("csv_layout", output.CSVLayoutLong, "CSV layout (long: row per value, wide: column per metering point)")
+	cfg.argmap["csv_time_layout"] = fs.String("csv_time_layout", time.RFC3339, "CSV timestamp layout in Go reference time format")
+	cfg.argmap["chart_width"] = fs.Int("chart_width", 0, "Chart width in columns (default terminal width, $COLUMNS or 80)")
+	cfg.argmap["chart_ascii"] = fs.Bool("chart_ascii", false, "Draw charts with plain ASCII characters")
+	cfg.argmap["template"] = fs.String("template", "", "Go text/template file for the template output")
 	return cfg
 }
 
+func newDataSource(cfg *Config) (caruna.DataSource, error) {
+	var logger *log.Logger
+	if cfg.Debug {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	switch cfg.Backend {
+	case CsvBackend:
+		return input.NewCarunaCSVSource(cfg.InputFiles, cfg.TimeZone)
+	case DatahubBackend:
+		return input.NewDatahubSource(cfg.InputFiles, cfg.TimeZone)
+	case PlusBackend:
+		return caruna.NewCarunaPlusClient(cfg.CarunaUsername, cfg.CarunaPassword, &caruna.PlusClientOpts{
+			Logger:  logger,
+			AuthUrl: cfg.PlusAuthUrl,
+			ApiUrl:  cfg.PlusApiUrl,
+		})
+	default:
+		return caruna.NewCarunaClient(cfg.CarunaUrl, cfg.CarunaUsername, cfg.CarunaPassword, &caruna.ClientOpts{
+			Logger: logger,
+		})
+	}
+}
+
+func reconcileDatahub(client caruna.DataSource, cfg *Config) ([]reconcile.HourDifference, error) {
+	datahub, err := input.NewDatahubSource(cfg.DatahubFiles, cfg.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	datahubValues, err := datahub.GetHourlySeries("", cfg.TimeStart, cfg.TimeStop)
+	if err != nil {
+		return nil, err
+	}
+	carunaValues, err := client.GetHourlySeries(cfg.Location, cfg.TimeStart, cfg.TimeStop)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only compare the selected metering points
+	if cfg.Location != "" {
+		selected := make(map[string]bool)
+		for _, e := range carunaValues {
+			selected[e.MeteringPointId] = true
+		}
+		filtered := make([]caruna.HourlyEnergyMeasurement, 0)
+		for _, e := range datahubValues {
+			id := e.MeteringPointId
+			if mapped, ok := cfg.DatahubMap[id]; ok {
+				id = mapped
+			}
+			if selected[id] {
+				filtered = append(filtered, e)
+			}
+		}
+		datahubValues = filtered
+	}
+	diffs, unmatched := reconcile.Compare(datahubValues, carunaValues, cfg.DatahubMap, cfg.ReconcileTolerance)
+	for _, id := range unmatched {
+		fmt.Fprintf(os.Stderr, "WARNING: Datahub metering point %s does not match a Caruna metering point, map it with -datahub_map\n", id)
+	}
+	return diffs, nil
+}
+
 func CliMain() {
 	config = NewConfig()
 
@@ -190,53 +477,143 @@ func CliMain() {
 		return
 	}
 
-	clientOpts := &caruna.ClientOpts{}
-	if config.Debug {
-		clientOpts.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	if config.Mode == ServeMode {
+		if err := serve(config); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	// Create the outputs first so that configuration errors surface before login
+	query := &output.Query{Start: config.TimeStart, Stop: config.TimeStop}
+	out := output.NewMultiOutput()
+	for _, spec := range config.Outputs {
+		outputOpts := output.Options{
+			Writer:      os.Stdout,
+			Location:    config.TimeZone,
+			InfluxDB:    config.InfluxDB,
+			InfluxDB2:   config.InfluxDB2,
+			InfluxDB08:  config.InfluxDB08,
+			Spool:       config.Spool,
+			RemoteWrite: config.RemoteWrite,
+			Text:        config.Text,
+			CSV:         config.CSV,
+			Chart:       config.Chart,
+			Template:    config.Template,
+			Query:       query,
+		}
+		if config.Debug {
+			outputOpts.Logger = log.New(os.Stderr, "", log.LstdFlags)
+		}
+		o, err := output.Open(spec, outputOpts)
+		if err != nil {
+			out.Abort()
+			fatal(fmt.Errorf("%s: %s", spec, err))
+			return
+		}
+		out.Add(spec.String(), o)
 	}
 
-	client, err := caruna.NewCarunaClient(config.CarunaUrl, config.CarunaUsername, config.CarunaPassword, clientOpts)
+	client, err := newDataSource(config)
 	if err != nil {
+		out.Abort()
 		fatal(err)
 		return
 	}
 	defer client.Logout()
 
-	var res interface{}
+	var errs []error
+	query.Customer = client.Customer()
+	err = writeOutput(client, out, query, config)
+	if err != nil {
+		errs = append(errs, flattenErrors(err)...)
+	}
 
-	switch config.Mode {
-	case LocationMode:
-		res, err = client.GetMeteringPoints()
-	case SeriesMode:
-		res, err = client.GetHourlySeries(config.Location, config.TimeStart, config.TimeStop)
+	// Don't replace target files with partial data if fetching failed
+	finish := out.Close
+	for _, err := range errs {
+		if _, ok := err.(fetchError); ok {
+			finish = out.Abort
+		}
 	}
-	if err != nil {
-		fatal(err)
+	if err := finish(); err != nil {
+		errs = append(errs, flattenErrors(err)...)
+	}
+	if len(errs) > 0 {
+		fatal(errs...)
 		return
 	}
-	switch config.Output {
-	case TextOutput:
-		output.PrintTextOutput(res)
-	case JsonOutput:
-		output.PrintJsonOutput(res)
-	case InfluxDbOutput:
-		vals, ok := res.([]caruna.HourlyEnergyMeasurement)
-		if ok {
-			influxOutput, err := output.NewInfluxDBOutput(config.InfluxDB)
-			if err != nil {
-				fatal(err)
-				return
-			}
-			if config.Debug {
-				influxOutput.SetLogger(log.New(os.Stderr, "", log.LstdFlags))
+}
+
+func serve(cfg *Config) error {
+	exp := exporter.NewExporter(cfg.Exporter, func() (caruna.DataSource, error) {
+		return newDataSource(cfg)
+	})
+	if cfg.Debug {
+		exp.SetLogger(log.New(os.Stderr, "", log.LstdFlags))
+	}
+	return exp.Run()
+}
+
+// fetchError is a data source error, as opposed to an output error
+type fetchError struct {
+	error
+}
+
+// Each output reports its own errors
+func flattenErrors(err error) []error {
+	if me, ok := err.(output.MultiError); ok {
+		return me
+	}
+	return []error{err}
+}
+
+func writeOutput(client caruna.DataSource, out *output.MultiOutput, query *output.Query, cfg *Config) error {
+	switch cfg.Mode {
+	case LocationMode:
+		mps, err := client.GetMeteringPoints()
+		if err != nil {
+			return fetchError{err}
+		}
+		query.MeteringPoints = mps
+		return out.WriteMeteringPoints(mps)
+	case SeriesMode:
+		mps, err := client.GetMeteringPoints()
+		if err != nil {
+			return fetchError{fmt.Errorf("Cannot get metering points: %s", err)}
+		}
+		query.MeteringPoints = make([]caruna.MeteringPoint, 0)
+		for _, mp := range mps {
+			if caruna.MatchMeteringPoint(mp, cfg.Location) {
+				query.MeteringPoints = append(query.MeteringPoints, mp)
 			}
-			err = influxOutput.WriteData(vals)
+		}
+
+		// Hand each metering point to the outputs as soon as it is fetched. Output
+		// errors are collected so that one failing output doesn't stop the others.
+		var errs output.MultiError
+		for _, mp := range query.MeteringPoints {
+			hms, err := client.GetMeteringPointSeries(mp, cfg.TimeStart, cfg.TimeStop)
 			if err != nil {
-				fatal(err)
-				return
+				errs = append(errs, fetchError{err})
+				return errs
+			}
+			if err := out.WriteMeasurements(hms); err != nil {
+				errs = append(errs, flattenErrors(err)...)
 			}
 		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	case ReconcileMode:
+		diffs, err := reconcileDatahub(client, cfg)
+		if err != nil {
+			return fetchError{err}
+		}
+		return out.WriteReconcileReport(diffs)
 	}
+	return nil
 }
 
 func main() {
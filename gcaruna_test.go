@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDatesInTimeZone(t *testing.T) {
+	for _, tc := range []struct {
+		tz          string
+		start, stop time.Time
+	}{
+		// Spring forward, the local day has 23 hours
+		{"Europe/Helsinki", time.Date(2024, 3, 30, 22, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 21, 0, 0, 0, time.UTC)},
+		{"UTC", time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		cfg := NewConfig()
+		if err := cfg.Parse([]string{"-tz", tc.tz, "-start", "2024-03-31", "-stop", "2024-04-01"}); err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.TimeStart.Equal(tc.start) || !cfg.TimeStop.Equal(tc.stop) {
+			t.Errorf("%s: got %s - %s, want %s - %s", tc.tz, cfg.TimeStart, cfg.TimeStop, tc.start, tc.stop)
+		}
+		if cfg.TimeStart.Location() != time.UTC || cfg.TimeStop.Location() != time.UTC {
+			t.Errorf("%s: times are not UTC: %s - %s", tc.tz, cfg.TimeStart, cfg.TimeStop)
+		}
+	}
+}
+
+func TestParseFallBackDay(t *testing.T) {
+	cfg := NewConfig()
+	if err := cfg.Parse([]string{"-tz", "Europe/Helsinki", "-start", "2024-10-27", "-stop", "2024-10-28"}); err != nil {
+		t.Fatal(err)
+	}
+	if d := cfg.TimeStop.Sub(cfg.TimeStart); d != 25*time.Hour {
+		t.Errorf("2024-10-27 is %s long, want 25h", d)
+	}
+}
+
+func TestParseReconcileWindow(t *testing.T) {
+	for _, tc := range []struct {
+		args   []string
+		window time.Duration
+	}{
+		// Default -rstart is shorter than the window
+		{[]string{"-influxdb_reconcile"}, 30 * 24 * time.Hour},
+		{[]string{"-influxdb_reconcile", "-influxdb_reconcile_window", "24h"}, 48 * time.Hour},
+		{[]string{"-influxdb_reconcile_window", "240h"}, 48 * time.Hour},
+	} {
+		cfg := NewConfig()
+		if err := cfg.Parse(tc.args); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(cfg.TimeStart); d < tc.window || d > tc.window+time.Minute {
+			t.Errorf("%v: start is %s ago, want %s", tc.args, d, tc.window)
+		}
+	}
+
+	// An explicit range is not extended
+	cfg := NewConfig()
+	if err := cfg.Parse([]string{"-influxdb_reconcile", "-tz", "UTC", "-start", "2024-03-31", "-stop", "2024-04-01"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC); !cfg.TimeStart.Equal(want) {
+		t.Errorf("got start %s, want %s", cfg.TimeStart, want)
+	}
+}
@@ -0,0 +1,117 @@
+package input
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+// Header prefixes used in Caruna portal CSV exports
+var (
+	carunaCSVTimeColumns          = []string{"aika", "ajankohta", "päivämäärä", "pvm", "timestamp", "time", "date"}
+	carunaCSVValueColumns         = []string{"kulutus", "energia", "consumption", "energy", "kwh"}
+	carunaCSVMeteringPointColumns = []string{"käyttöpaikka", "mittauspiste", "metering point", "meteringpoint"}
+)
+
+// CarunaCSVSource reads hourly consumption from CSV files exported by hand from the
+// Caruna portal. It implements caruna.DataSource so all outputs work without contacting Caruna.
+type CarunaCSVSource struct {
+	staticSource
+}
+
+func NewCarunaCSVSource(files []string, loc *time.Location) (*CarunaCSVSource, error) {
+	ret := &CarunaCSVSource{}
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		// Exports without a metering point column are named after the file
+		defaultId := strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+		mps, hms, err := ParseCarunaCSV(f, defaultId, loc)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		ret.add(mps, hms)
+	}
+	return ret, nil
+}
+
+// ParseCarunaCSV parses one portal export. Timestamps are local wall clock times in loc
+// and values use decimal commas.
+func ParseCarunaCSV(r io.Reader, defaultId string, loc *time.Location) ([]caruna.MeteringPoint, []caruna.HourlyEnergyMeasurement, error) {
+	cr, err := newCSVReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read CSV header: %s", err)
+	}
+
+	tsCol := findColumn(header, carunaCSVTimeColumns...)
+	valCol := findColumn(header, carunaCSVValueColumns...)
+	mpCol := findColumn(header, carunaCSVMeteringPointColumns...)
+	if tsCol == -1 || valCol == -1 {
+		return nil, nil, fmt.Errorf("Cannot find timestamp and consumption columns in header: %v", header)
+	}
+
+	mps := make([]caruna.MeteringPoint, 0)
+	seen := make(map[string]bool)
+	hms := make([]caruna.HourlyEnergyMeasurement, 0)
+	times := newLocalTimeParser(loc)
+
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rec) <= tsCol || len(rec) <= valCol || strings.TrimSpace(rec[tsCol]) == "" {
+			continue
+		}
+
+		id := defaultId
+		if mpCol != -1 && mpCol < len(rec) && strings.TrimSpace(rec[mpCol]) != "" {
+			id = strings.TrimSpace(rec[mpCol])
+		}
+		if !seen[id] {
+			seen[id] = true
+			mps = append(mps, caruna.MeteringPoint{
+				MeteringPointNumber: id,
+				HourlyMeasured:      true,
+				Location:            []string{id},
+			})
+		}
+
+		ts, err := times.Parse(id, rec[tsCol])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		// Missing hours are exported as empty values
+		if strings.TrimSpace(rec[valCol]) == "" {
+			continue
+		}
+		val, err := parseDecimal(rec[valCol])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: Cannot parse value: %s", line, rec[valCol])
+		}
+
+		hms = append(hms, caruna.HourlyEnergyMeasurement{
+			MeteringPointId:       id,
+			MeteringPointLocation: []string{id},
+			Timestamp:             ts,
+			Value:                 val,
+		})
+	}
+	return mps, hms, nil
+}
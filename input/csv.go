@@ -0,0 +1,138 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newCSVReader sniffs the delimiter from the header line and strips a possible UTF-8 BOM
+func newCSVReader(r io.Reader) (*csv.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(4096)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if bytes.HasPrefix(head, []byte("\xef\xbb\xbf")) {
+		br.Discard(3)
+		head = head[3:]
+	}
+	if i := bytes.IndexByte(head, '\n'); i != -1 {
+		head = head[:i]
+	}
+
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+	switch {
+	case bytes.Count(head, []byte(";")) > 0:
+		cr.Comma = ';'
+	case bytes.Count(head, []byte("\t")) > 0:
+		cr.Comma = '\t'
+	default:
+		cr.Comma = ','
+	}
+	return cr, nil
+}
+
+// findColumn returns the index of the header matching the given prefixes (case insensitive).
+// Prefixes are tried in order across all headers, so more specific prefixes go first.
+func findColumn(header []string, prefixes ...string) int {
+	for _, p := range prefixes {
+		for i, h := range header {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(h)), p) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// parseDecimal accepts both Finnish (1 234,5) and plain (1234.5) number formats
+func parseDecimal(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	s = strings.Replace(s, " ", "", -1)
+	s = strings.Replace(s, "\u00a0", "", -1)
+	if strings.Contains(s, ",") {
+		s = strings.Replace(s, ".", "", -1)
+		s = strings.Replace(s, ",", ".", -1)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+var localTimeLayouts = []string{
+	"2.1.2006 15:04",
+	"2.1.2006 15.04",
+	"2.1.2006 15:04:05",
+	"2.1.2006 15.04.05",
+	"2.1.2006",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// localTimeParser turns wall clock timestamps into instants. Wall clock times are
+// ambiguous during the autumn DST fall-back, the hour is repeated with a different
+// offset. Files list hours in order, so a repeated wall clock hour is resolved to the
+// later instant.
+type localTimeParser struct {
+	loc  *time.Location
+	prev map[string]time.Time
+}
+
+func newLocalTimeParser(loc *time.Location) *localTimeParser {
+	return &localTimeParser{loc: loc, prev: make(map[string]time.Time)}
+}
+
+// Parse parses s, key identifies the series so that interleaved series don't affect each other
+func (self *localTimeParser) Parse(key, s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+
+	// Explicit offsets need no guessing
+	if ts, err := time.Parse(time.RFC3339, s); err == nil {
+		self.prev[key] = ts
+		return ts.UTC(), nil
+	}
+
+	var wall time.Time
+	var err error
+	for _, layout := range localTimeLayouts {
+		wall, err = time.Parse(layout, s)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Cannot parse timestamp: %s", s)
+	}
+
+	ts := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, self.loc)
+	prev, seen := self.prev[key]
+	switch {
+	case !seen || ts.After(prev):
+		// Prefer the earlier instant of an ambiguous hour if it still follows the previous row
+		if e := ts.Add(-time.Hour); sameWallClock(e, ts, self.loc) && (!seen || e.After(prev)) {
+			ts = e
+		}
+	default:
+		if l := ts.Add(time.Hour); sameWallClock(l, ts, self.loc) && l.After(prev) {
+			ts = l
+		}
+	}
+	self.prev[key] = ts
+	return ts.UTC(), nil
+}
+
+func sameWallClock(a, b time.Time, loc *time.Location) bool {
+	a, b = a.In(loc), b.In(loc)
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay() &&
+		a.Hour() == b.Hour() && a.Minute() == b.Minute()
+}
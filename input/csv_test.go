@@ -0,0 +1,74 @@
+package input
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func helsinki(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("time zone data not available:", err)
+	}
+	return loc
+}
+
+func TestLocalTimeParserFallBack(t *testing.T) {
+	// 2024-10-27 04:00 EEST becomes 03:00 EET, 03:00 local time happens twice
+	p := newLocalTimeParser(helsinki(t))
+	want := map[string][]string{
+		"27.10.2024 2:00": {"2024-10-26T23:00:00Z"},
+		"27.10.2024 3:00": {"2024-10-27T00:00:00Z", "2024-10-27T01:00:00Z"},
+		"27.10.2024 4:00": {"2024-10-27T02:00:00Z"},
+	}
+	rows := []string{"27.10.2024 2:00", "27.10.2024 3:00", "27.10.2024 3:00", "27.10.2024 4:00"}
+	seen := make(map[string]int)
+	for _, row := range rows {
+		ts, err := p.Parse("mp", row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := want[row][seen[row]]
+		seen[row]++
+		if got := ts.Format(time.RFC3339); got != expected {
+			t.Errorf("%s (#%d) = %s, want %s", row, seen[row], got, expected)
+		}
+	}
+}
+
+func TestLocalTimeParserSpringForward(t *testing.T) {
+	// 2024-03-31 03:00 EET becomes 04:00 EEST, the day has 23 hours
+	var rows []string
+	for h := 0; h < 24; h++ {
+		if h == 3 {
+			continue
+		}
+		rows = append(rows, "31.3.2024 "+time.Date(2024, 1, 1, h, 0, 0, 0, time.UTC).Format("15:04")+";1")
+	}
+	data := "Aika;Kulutus\n" + strings.Join(rows, "\n") + "\n"
+	_, hms, err := ParseCarunaCSV(strings.NewReader(data), "mp", helsinki(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hms) != 23 {
+		t.Fatalf("got %d hours, want 23", len(hms))
+	}
+	start := time.Date(2024, 3, 30, 22, 0, 0, 0, time.UTC)
+	for i, e := range hms {
+		if want := start.Add(time.Duration(i) * time.Hour); !e.Timestamp.Equal(want) {
+			t.Errorf("hour %d = %s, want %s", i, e.Timestamp, want)
+		}
+	}
+}
+
+func TestLocalTimeParserExplicitOffset(t *testing.T) {
+	p := newLocalTimeParser(helsinki(t))
+	ts, err := p.Parse("mp", "2024-10-27T03:00:00+02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 10, 27, 1, 0, 0, 0, time.UTC); !ts.Equal(want) || ts.Location() != time.UTC {
+		t.Errorf("got %s, want %s", ts, want)
+	}
+}
@@ -0,0 +1,147 @@
+package input
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+const (
+	// Datahub product type for active energy consumption
+	DatahubProductConsumption = "8716867000030"
+
+	DatahubResolutionHour    = "PT1H"
+	DatahubResolutionQuarter = "PT15M"
+	DatahubMeteringPointType = "GSRN"
+)
+
+// Header prefixes used in Fingrid Datahub customer portal exports (english and finnish)
+var (
+	datahubGSRNColumns       = []string{"metering point", "gsrn", "käyttöpaikka", "mittauspiste"}
+	datahubProductColumns    = []string{"product type", "tuotetyyppi"}
+	datahubResolutionColumns = []string{"resolution", "aikaresoluutio", "resoluutio"}
+	datahubTimeColumns       = []string{"start time", "alkuaika"}
+	datahubQuantityColumns   = []string{"quantity", "määrä", "kulutus"}
+)
+
+// DatahubSource reads hourly consumption from Fingrid Datahub CSV exports. Metering points
+// are identified by their GSRN. Quarter hour readings are summed into hours.
+type DatahubSource struct {
+	staticSource
+}
+
+func NewDatahubSource(files []string, loc *time.Location) (*DatahubSource, error) {
+	ret := &DatahubSource{}
+	for _, fn := range files {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		mps, hms, err := ParseDatahubCSV(f, loc)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		ret.add(mps, hms)
+	}
+	return ret, nil
+}
+
+// ParseDatahubCSV parses one Datahub export. Timestamps normally carry an explicit
+// offset, timestamps without one are interpreted in loc.
+func ParseDatahubCSV(r io.Reader, loc *time.Location) ([]caruna.MeteringPoint, []caruna.HourlyEnergyMeasurement, error) {
+	cr, err := newCSVReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read CSV header: %s", err)
+	}
+
+	gsrnCol := findColumn(header, datahubGSRNColumns...)
+	productCol := findColumn(header, datahubProductColumns...)
+	resCol := findColumn(header, datahubResolutionColumns...)
+	tsCol := findColumn(header, datahubTimeColumns...)
+	qtyCol := findColumn(header, datahubQuantityColumns...)
+	if gsrnCol == -1 || tsCol == -1 || qtyCol == -1 {
+		return nil, nil, fmt.Errorf("Cannot find metering point, start time and quantity columns in header: %v", header)
+	}
+
+	mps := make([]caruna.MeteringPoint, 0)
+	seen := make(map[string]bool)
+	hms := make([]caruna.HourlyEnergyMeasurement, 0)
+	// Index of the hour in hms, used to sum quarter hour readings
+	hours := make(map[string]int)
+	times := newLocalTimeParser(loc)
+
+	field := func(rec []string, col int) string {
+		if col == -1 || col >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[col])
+	}
+
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		gsrn := field(rec, gsrnCol)
+		if gsrn == "" || field(rec, tsCol) == "" {
+			continue
+		}
+		if product := field(rec, productCol); product != "" && product != DatahubProductConsumption {
+			continue
+		}
+		resolution := strings.ToUpper(field(rec, resCol))
+		if resolution != "" && resolution != DatahubResolutionHour && resolution != DatahubResolutionQuarter {
+			return nil, nil, fmt.Errorf("line %d: Unsupported resolution: %s", line, resolution)
+		}
+
+		if !seen[gsrn] {
+			seen[gsrn] = true
+			mps = append(mps, caruna.MeteringPoint{
+				MeteringPointNumber: gsrn,
+				MeteringPointType:   DatahubMeteringPointType,
+				HourlyMeasured:      true,
+				Location:            []string{gsrn},
+			})
+		}
+
+		ts, err := times.Parse(gsrn+"/"+resolution, field(rec, tsCol))
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if field(rec, qtyCol) == "" {
+			continue
+		}
+		val, err := parseDecimal(field(rec, qtyCol))
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: Cannot parse quantity: %s", line, field(rec, qtyCol))
+		}
+
+		hour := ts.Truncate(time.Hour)
+		key := fmt.Sprintf("%s/%d", gsrn, hour.Unix())
+		if i, ok := hours[key]; ok {
+			hms[i].Value += val
+			continue
+		}
+		hours[key] = len(hms)
+		hms = append(hms, caruna.HourlyEnergyMeasurement{
+			MeteringPointId:       gsrn,
+			MeteringPointLocation: []string{gsrn},
+			Timestamp:             hour,
+			Value:                 val,
+		})
+	}
+	return mps, hms, nil
+}
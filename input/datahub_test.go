@@ -0,0 +1,56 @@
+package input
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDatahubCSVFinnishHeader(t *testing.T) {
+	data := "Käyttöpaikka;Tuotetyyppi;Aikaresoluutio;Yksikkö;Alkuaika;Määrä\n" +
+		"643007574000000001;8716867000030;PT1H;kWh;2024-01-01T00:00:00+02:00;1,5\n" +
+		"643007574000000001;8716867000030;PT1H;kWh;2024-01-01T01:00:00+02:00;2,25\n" +
+		"643007574000000001;8716867000016;PT1H;kWh;2024-01-01T01:00:00+02:00;9\n"
+	loc, _ := time.LoadLocation("Europe/Helsinki")
+	mps, hms, err := ParseDatahubCSV(strings.NewReader(data), loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mps) != 1 || mps[0].MeteringPointNumber != "643007574000000001" {
+		t.Fatalf("unexpected metering points: %+v", mps)
+	}
+	if len(hms) != 2 {
+		t.Fatalf("got %d measurements, want 2", len(hms))
+	}
+	if want := time.Date(2023, 12, 31, 22, 0, 0, 0, time.UTC); !hms[0].Timestamp.Equal(want) {
+		t.Errorf("timestamp = %s, want %s", hms[0].Timestamp, want)
+	}
+	if hms[0].Value != 1.5 || hms[1].Value != 2.25 {
+		t.Errorf("values = %v, %v, want 1.5, 2.25", hms[0].Value, hms[1].Value)
+	}
+}
+
+func TestParseDatahubCSVQuarterHours(t *testing.T) {
+	data := "Metering point;Product type;Resolution;Start time;Quantity\n" +
+		"gsrn1;8716867000030;PT15M;2024-01-01T00:00:00Z;0.25\n" +
+		"gsrn1;8716867000030;PT15M;2024-01-01T00:15:00Z;0.25\n" +
+		"gsrn1;8716867000030;PT15M;2024-01-01T00:30:00Z;0.5\n" +
+		"gsrn1;8716867000030;PT15M;2024-01-01T00:45:00Z;1\n"
+	_, hms, err := ParseDatahubCSV(strings.NewReader(data), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hms) != 1 || hms[0].Value != 2 {
+		t.Fatalf("expected one hour of 2 kWh, got %+v", hms)
+	}
+}
+
+func TestFindColumnPriority(t *testing.T) {
+	header := []string{"Käyttöpaikka", "Aikaresoluutio", "Alkuaika"}
+	if i := findColumn(header, datahubTimeColumns...); i != 2 {
+		t.Errorf("time column = %d, want 2", i)
+	}
+	if i := findColumn(header, datahubResolutionColumns...); i != 1 {
+		t.Errorf("resolution column = %d, want 1", i)
+	}
+}
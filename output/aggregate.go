@@ -0,0 +1,133 @@
+package output
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+// Group is a set of measurements, for example one metering point or one day
+type Group struct {
+	Key          string
+	Start        time.Time
+	Measurements []caruna.HourlyEnergyMeasurement
+}
+
+func (self *Group) Count() int {
+	return len(self.Measurements)
+}
+
+func (self *Group) Sum() float64 {
+	return sumValues(self.Measurements)
+}
+
+func (self *Group) Avg() float64 {
+	if len(self.Measurements) == 0 {
+		return 0
+	}
+	return self.Sum() / float64(len(self.Measurements))
+}
+
+func (self *Group) Min() float64 {
+	ret := 0.0
+	for i, e := range self.Measurements {
+		if i == 0 || e.Value < ret {
+			ret = e.Value
+		}
+	}
+	return ret
+}
+
+func (self *Group) Max() float64 {
+	return self.Peak().Value
+}
+
+// Peak returns the hour with the highest consumption, the earliest one on ties
+func (self *Group) Peak() caruna.HourlyEnergyMeasurement {
+	var ret caruna.HourlyEnergyMeasurement
+	for i, e := range self.Measurements {
+		if i == 0 || e.Value > ret.Value {
+			ret = e
+		}
+	}
+	return ret
+}
+
+func sumValues(hms []caruna.HourlyEnergyMeasurement) float64 {
+	sum := 0.0
+	for _, e := range hms {
+		sum += e.Value
+	}
+	return sum
+}
+
+// GroupByMeteringPoint groups in order of first appearance, keyed by metering point id
+func GroupByMeteringPoint(hms []caruna.HourlyEnergyMeasurement) []*Group {
+	ret := make([]*Group, 0)
+	index := make(map[string]*Group)
+	for _, e := range hms {
+		g, ok := index[e.MeteringPointId]
+		if !ok {
+			g = &Group{Key: e.MeteringPointId, Start: e.Timestamp}
+			index[e.MeteringPointId] = g
+			ret = append(ret, g)
+		}
+		if e.Timestamp.Before(g.Start) {
+			g.Start = e.Timestamp
+		}
+		g.Measurements = append(g.Measurements, e)
+	}
+	return ret
+}
+
+// GroupByPeriod groups into calendar periods in loc, sorted by time. Weeks start on monday.
+func GroupByPeriod(hms []caruna.HourlyEnergyMeasurement, period string, loc *time.Location) ([]*Group, error) {
+	index := make(map[int64]*Group)
+	ret := make([]*Group, 0)
+	for _, e := range hms {
+		start, key, err := periodStart(e.Timestamp, period, loc)
+		if err != nil {
+			return nil, err
+		}
+		g, ok := index[start.Unix()]
+		if !ok {
+			g = &Group{Key: key, Start: start}
+			index[start.Unix()] = g
+			ret = append(ret, g)
+		}
+		g.Measurements = append(g.Measurements, e)
+	}
+	sort.Sort(groupsByStart(ret))
+	return ret, nil
+}
+
+func periodStart(t time.Time, period string, loc *time.Location) (time.Time, string, error) {
+	t = t.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	switch period {
+	case PeriodDay:
+		return day, day.Format("2006-01-02"), nil
+	case PeriodWeek:
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		year, week := start.ISOWeek()
+		return start, fmt.Sprintf("%d-W%02d", year, week), nil
+	case PeriodMonth:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.Format("2006-01"), nil
+	}
+	return time.Time{}, "", fmt.Errorf("unknown period: %s", period)
+}
+
+type groupsByStart []*Group
+
+func (s groupsByStart) Len() int           { return len(s) }
+func (s groupsByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s groupsByStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
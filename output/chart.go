@@ -0,0 +1,255 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+const defaultChartWidth = 80
+
+// Glyph sets from lowest to highest
+var (
+	sparkUnicode = []rune("▁▂▃▄▅▆▇█")
+	sparkASCII   = []rune("_.-:=+*#")
+	heatUnicode  = []rune(" ░▒▓█")
+	heatASCII    = []rune(" .:*#")
+	barsUnicode  = []rune(" ▏▎▍▌▋▊▉█")
+)
+
+type ChartConfig struct {
+	// Terminal width, zero means the width of the output terminal, $COLUMNS or 80
+	Width int
+	// Restrict to plain ASCII characters
+	ASCII bool
+}
+
+func init() {
+	RegisterWriter("chart", func(opts *Options) (Output, error) {
+		config := opts.Chart
+		if config == nil {
+			config = &ChartConfig{}
+		}
+		return NewChartOutput(opts.Writer, opts.Location, config), nil
+	})
+}
+
+// ChartOutput draws a sparkline, daily totals and an hour of day heatmap per metering point
+type ChartOutput struct {
+	w            io.Writer
+	loc          *time.Location
+	width        int
+	ascii        bool
+	measurements []caruna.HourlyEnergyMeasurement
+}
+
+func (self *ChartOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	return &ErrNotSupported{Output: "chart", Data: "metering points"}
+}
+
+func (self *ChartOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	self.measurements = append(self.measurements, hms...)
+	return nil
+}
+
+func (self *ChartOutput) Close() error {
+	buf := &bytes.Buffer{}
+	for i, point := range GroupByMeteringPoint(self.measurements) {
+		if i != 0 {
+			fmt.Fprintln(buf)
+		}
+		first := point.Measurements[0]
+		fmt.Fprintf(buf, "Metering point %s (%s)\n", point.Key, strings.Join(first.MeteringPointLocation, " "))
+		fmt.Fprintf(buf, "Total %.3f kWh, peak %.3f kWh at %s\n\n", point.Sum(), point.Max(),
+			point.Peak().Timestamp.In(self.loc).Format("2006-01-02 15:04"))
+		if err := self.writeSparkline(buf, point); err != nil {
+			return err
+		}
+		if err := self.writeDailyBars(buf, point); err != nil {
+			return err
+		}
+		if err := self.writeHeatmap(buf, point); err != nil {
+			return err
+		}
+	}
+	_, err := self.w.Write(buf.Bytes())
+	return err
+}
+
+// writeSparkline draws the hourly series, averaging neighbouring hours if it doesn't fit
+func (self *ChartOutput) writeSparkline(w io.Writer, point *Group) error {
+	values := make([]float64, len(point.Measurements))
+	for i, e := range point.Measurements {
+		values[i] = e.Value
+	}
+	values = downsample(values, self.width)
+	glyphs := sparkUnicode
+	if self.ascii {
+		glyphs = sparkASCII
+	}
+
+	min, max := minMax(values)
+	line := make([]rune, len(values))
+	for i, v := range values {
+		line[i] = glyphs[scale(v, min, max, len(glyphs))]
+	}
+	fmt.Fprintf(w, "Hourly (%.3f - %.3f kWh)\n%s\n\n", min, max, string(line))
+	return nil
+}
+
+func (self *ChartOutput) writeDailyBars(w io.Writer, point *Group) error {
+	days, err := GroupByPeriod(point.Measurements, PeriodDay, self.loc)
+	if err != nil {
+		return err
+	}
+	max := 0.0
+	for _, d := range days {
+		max = math.Max(max, d.Sum())
+	}
+
+	fmt.Fprintln(w, "Daily totals (kWh)")
+	// Room for "2006-01-02 " and " 1234.567"
+	barWidth := self.width - 11 - 10
+	if barWidth < 10 {
+		barWidth = 10
+	}
+	for _, d := range days {
+		fmt.Fprintf(w, "%s %s %.3f\n", d.Key, self.bar(d.Sum(), max, barWidth), d.Sum())
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// bar draws a horizontal bar of v relative to max, using eighth blocks in unicode mode.
+// Negative values, such as net production, are drawn as empty bars.
+func (self *ChartOutput) bar(v, max float64, width int) string {
+	if max <= 0 {
+		return strings.Repeat(" ", width)
+	}
+	v = math.Max(0, math.Min(v, max))
+	if self.ascii {
+		n := int(v / max * float64(width))
+		return strings.Repeat("#", n) + strings.Repeat(" ", width-n)
+	}
+	eighths := int(v / max * float64(width*8))
+	full := eighths / 8
+	ret := strings.Repeat(string(barsUnicode[8]), full)
+	pad := width - full
+	if rest := eighths % 8; rest > 0 {
+		ret += string(barsUnicode[rest])
+		pad--
+	}
+	return ret + strings.Repeat(" ", pad)
+}
+
+// writeHeatmap draws hours of day as rows and days as columns. When there are more
+// days than fit the terminal, the most recent days are shown.
+func (self *ChartOutput) writeHeatmap(w io.Writer, point *Group) error {
+	days, err := GroupByPeriod(point.Measurements, PeriodDay, self.loc)
+	if err != nil {
+		return err
+	}
+	// Row label "23 " takes three columns
+	if maxDays := self.width - 3; len(days) > maxDays && maxDays > 0 {
+		days = days[len(days)-maxDays:]
+	}
+
+	// The repeated hour of the autumn DST change is summed into the same cell
+	cells := make([][24]float64, len(days))
+	present := make([][24]bool, len(days))
+	min, max := math.Inf(1), math.Inf(-1)
+	for i, d := range days {
+		for _, e := range d.Measurements {
+			h := e.Timestamp.In(self.loc).Hour()
+			cells[i][h] += e.Value
+			present[i][h] = true
+		}
+		for h := 0; h < 24; h++ {
+			if present[i][h] {
+				min = math.Min(min, cells[i][h])
+				max = math.Max(max, cells[i][h])
+			}
+		}
+	}
+	glyphs := heatUnicode
+	if self.ascii {
+		glyphs = heatASCII
+	}
+
+	fmt.Fprintf(w, "Hour of day heatmap %s - %s (%.3f - %.3f kWh)\n", days[0].Key, days[len(days)-1].Key, min, max)
+	for h := 0; h < 24; h++ {
+		line := make([]rune, len(days))
+		for i := range days {
+			line[i] = ' '
+			if present[i][h] {
+				// Lowest glyph is blank, keep it for missing hours
+				line[i] = glyphs[1+scale(cells[i][h], min, max, len(glyphs)-1)]
+			}
+		}
+		fmt.Fprintf(w, "%02d %s\n", h, string(line))
+	}
+	return nil
+}
+
+func NewChartOutput(w io.Writer, loc *time.Location, config *ChartConfig) *ChartOutput {
+	width := config.Width
+	if f, ok := w.(*os.File); ok && width <= 0 {
+		width = terminalWidth(f.Fd())
+	}
+	if width <= 0 {
+		width, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+	}
+	if width <= 0 {
+		width = defaultChartWidth
+	}
+	return &ChartOutput{w: w, loc: loc, width: width, ascii: config.ASCII}
+}
+
+// downsample averages values into at most n buckets
+func downsample(values []float64, n int) []float64 {
+	if len(values) <= n || n <= 0 {
+		return values
+	}
+	ret := make([]float64, n)
+	for i := range ret {
+		start := i * len(values) / n
+		stop := (i + 1) * len(values) / n
+		sum := 0.0
+		for _, v := range values[start:stop] {
+			sum += v
+		}
+		ret[i] = sum / float64(stop-start)
+	}
+	return ret
+}
+
+func minMax(values []float64) (float64, float64) {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	return min, max
+}
+
+// scale maps v in [min, max] to 0..levels-1
+func scale(v, min, max float64, levels int) int {
+	if max <= min {
+		return levels - 1
+	}
+	i := int((v - min) / (max - min) * float64(levels))
+	if i >= levels {
+		i = levels - 1
+	}
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
@@ -0,0 +1,118 @@
+package output
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+var update = flag.Bool("update", false, "Rewrite golden files in testdata")
+
+// golden compares got to testdata/name, or rewrites it with -update
+func golden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs, got:\n%s", name, got)
+	}
+}
+
+func testLocation(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("Europe/Helsinki not available:", err)
+	}
+	return loc
+}
+
+// dstMeasurements covers local days 2024-10-26 - 2024-10-28, the 27th has 25 hours
+func dstMeasurements() []caruna.HourlyEnergyMeasurement {
+	start := time.Date(2024, 10, 25, 21, 0, 0, 0, time.UTC)
+	hms := testMeasurements("mp1", start, 24+25+24)
+	for i := range hms {
+		hms[i].Value = float64(i*7%10)/10 + 0.1
+	}
+	return hms
+}
+
+func TestChartDST(t *testing.T) {
+	loc := testLocation(t)
+	for _, c := range []struct {
+		name  string
+		ascii bool
+	}{
+		{"chart_dst.golden", false},
+		{"chart_dst_ascii.golden", true},
+	} {
+		var buf bytes.Buffer
+		out := NewChartOutput(&buf, loc, &ChartConfig{Width: 40, ASCII: c.ascii})
+		if err := out.WriteMeasurements(dstMeasurements()); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.Close(); err != nil {
+			t.Fatal(err)
+		}
+		golden(t, c.name, buf.Bytes())
+	}
+}
+
+// Only the most recent days fit, the repeated 03 hour of 2024-10-27 is summed
+func TestHeatmapNarrow(t *testing.T) {
+	loc := testLocation(t)
+	var buf bytes.Buffer
+	out := NewChartOutput(&buf, loc, &ChartConfig{Width: 5, ASCII: true})
+	if err := out.writeHeatmap(&buf, GroupByMeteringPoint(dstMeasurements())[0]); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "heatmap_narrow.golden", buf.Bytes())
+}
+
+func TestChartNegativeValues(t *testing.T) {
+	loc := testLocation(t)
+	hms := dstMeasurements()
+	// Net production on the first day
+	for i := 0; i < 24; i++ {
+		hms[i].Value = -hms[i].Value
+	}
+	var buf bytes.Buffer
+	out := NewChartOutput(&buf, loc, &ChartConfig{Width: 40})
+	if err := out.WriteMeasurements(hms); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	golden(t, "chart_negative.golden", buf.Bytes())
+}
+
+func TestChartBar(t *testing.T) {
+	out := &ChartOutput{}
+	for _, c := range []struct {
+		v, max float64
+		want   string
+	}{
+		{0, 10, "     "},
+		{10, 10, "█████"},
+		{5.25, 10, "██▋  "},
+		{-3, 10, "     "},
+		{12, 10, "█████"},
+		{1, 0, "     "},
+	} {
+		if got := out.bar(c.v, c.max, 5); got != c.want {
+			t.Errorf("bar(%g, %g): got %q, want %q", c.v, c.max, got, c.want)
+		}
+	}
+}
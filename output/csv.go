@@ -0,0 +1,223 @@
+package output
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+const (
+	// One row per metering point and hour
+	CSVLayoutLong = "long"
+	// One row per hour, one column per metering point
+	CSVLayoutWide = "wide"
+)
+
+type CSVConfig struct {
+	Delimiter  string
+	Decimal    string
+	Header     bool
+	Layout     string
+	TimeLayout string
+}
+
+func init() {
+	RegisterWriter("csv", func(opts *Options) (Output, error) {
+		config := opts.CSV
+		if config == nil {
+			config = &CSVConfig{Delimiter: ",", Decimal: ".", Header: true, Layout: CSVLayoutLong}
+		}
+		return NewCSVOutput(opts.Writer, opts.Location, config)
+	})
+}
+
+// CSVOutput writes spreadsheet friendly CSV. The long layout is streamed, the wide
+// layout is buffered until Close because columns are only known at the end.
+type CSVOutput struct {
+	w             *csv.Writer
+	loc           *time.Location
+	config        *CSVConfig
+	headerWritten bool
+
+	// Wide layout state
+	columns []string
+	names   map[string]string
+	rows    map[int64]map[string]float64
+}
+
+func (self *CSVOutput) formatValue(v float64) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if self.config.Decimal != "." {
+		s = strings.Replace(s, ".", self.config.Decimal, 1)
+	}
+	return s
+}
+
+func (self *CSVOutput) formatTime(t time.Time) string {
+	return t.In(self.loc).Format(self.config.TimeLayout)
+}
+
+func (self *CSVOutput) writeHeader(header []string) error {
+	if !self.config.Header || self.headerWritten {
+		return nil
+	}
+	self.headerWritten = true
+	return self.w.Write(header)
+}
+
+func (self *CSVOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	err := self.writeHeader([]string{"Id", "Location", "Type", "Hourly measured", "Contract begin"})
+	if err != nil {
+		return err
+	}
+	for _, e := range mps {
+		err := self.w.Write([]string{
+			e.MeteringPointNumber,
+			strings.Join(e.Location, " "),
+			e.MeteringPointType,
+			strconv.FormatBool(e.HourlyMeasured),
+			e.Created,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	self.w.Flush()
+	return self.w.Error()
+}
+
+func (self *CSVOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	if self.config.Layout == CSVLayoutWide {
+		for _, e := range hms {
+			if _, ok := self.names[e.MeteringPointId]; !ok {
+				self.columns = append(self.columns, e.MeteringPointId)
+				self.names[e.MeteringPointId] = strings.Join(e.MeteringPointLocation, " ")
+			}
+			ts := e.Timestamp.Unix()
+			if self.rows[ts] == nil {
+				self.rows[ts] = make(map[string]float64)
+			}
+			self.rows[ts][e.MeteringPointId] = e.Value
+		}
+		return nil
+	}
+
+	err := self.writeHeader([]string{"Timestamp", "Id", "Location", "KWh"})
+	if err != nil {
+		return err
+	}
+	for _, e := range hms {
+		err := self.w.Write([]string{
+			self.formatTime(e.Timestamp),
+			e.MeteringPointId,
+			strings.Join(e.MeteringPointLocation, " "),
+			self.formatValue(e.Value),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	self.w.Flush()
+	return self.w.Error()
+}
+
+func (self *CSVOutput) writeWide() error {
+	header := []string{"Timestamp"}
+	for _, id := range self.columns {
+		name := self.names[id]
+		if name == "" || name == id {
+			name = id
+		} else {
+			name = fmt.Sprintf("%s (%s)", name, id)
+		}
+		header = append(header, name)
+	}
+	if err := self.writeHeader(header); err != nil {
+		return err
+	}
+
+	timestamps := make([]int64, 0, len(self.rows))
+	for ts := range self.rows {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Sort(int64Slice(timestamps))
+
+	for _, ts := range timestamps {
+		line := []string{self.formatTime(time.Unix(ts, 0))}
+		for _, id := range self.columns {
+			v, ok := self.rows[ts][id]
+			if !ok {
+				line = append(line, "")
+				continue
+			}
+			line = append(line, self.formatValue(v))
+		}
+		if err := self.w.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *CSVOutput) Close() error {
+	if self.config.Layout == CSVLayoutWide && len(self.rows) > 0 {
+		if err := self.writeWide(); err != nil {
+			return err
+		}
+	}
+	self.w.Flush()
+	return self.w.Error()
+}
+
+func NewCSVOutput(w io.Writer, loc *time.Location, config *CSVConfig) (*CSVOutput, error) {
+	// Defaults are filled into a copy, the config may be shared by several outputs
+	c := *config
+	config = &c
+
+	delim := config.Delimiter
+	if delim == `\t` {
+		delim = "\t"
+	}
+	if utf8.RuneCountInString(delim) != 1 {
+		return nil, fmt.Errorf("csv delimiter must be a single character: %q", config.Delimiter)
+	}
+	if config.Decimal != "." && config.Decimal != "," {
+		return nil, fmt.Errorf("csv decimal separator must be . or ,: %q", config.Decimal)
+	}
+	if config.Decimal == delim {
+		return nil, fmt.Errorf("csv delimiter and decimal separator can't be the same")
+	}
+	switch config.Layout {
+	case CSVLayoutLong, CSVLayoutWide:
+	case "":
+		config.Layout = CSVLayoutLong
+	default:
+		return nil, fmt.Errorf("unknown csv layout: %s", config.Layout)
+	}
+	if config.TimeLayout == "" {
+		config.TimeLayout = time.RFC3339
+	}
+
+	ret := &CSVOutput{
+		w:      csv.NewWriter(w),
+		loc:    loc,
+		config: config,
+		names:  make(map[string]string),
+		rows:   make(map[int64]map[string]float64),
+	}
+	ret.w.Comma, _ = utf8.DecodeRuneInString(delim)
+	return ret, nil
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
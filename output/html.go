@@ -0,0 +1,323 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+// SVG chart geometry
+const (
+	htmlChartWidth   = 720
+	htmlChartHeight  = 200
+	htmlChartMargin  = 40
+	htmlHeatmapCellH = 10
+)
+
+func init() {
+	RegisterWriter("html", func(opts *Options) (Output, error) {
+		return NewHtmlOutput(opts.Writer, opts.Location, opts.Query), nil
+	})
+}
+
+// HtmlOutput writes a single self-contained HTML report with inline SVG charts.
+// Everything is rendered on Close, the file references no external resources.
+type HtmlOutput struct {
+	w            io.Writer
+	loc          *time.Location
+	query        *Query
+	points       []caruna.MeteringPoint
+	measurements []caruna.HourlyEnergyMeasurement
+}
+
+type svgRect struct {
+	X, Y, W, H float64
+	Fill       string
+	Title      string
+}
+
+type svgText struct {
+	X, Y   float64
+	Anchor string
+	Text   string
+}
+
+type svgChart struct {
+	Width, Height float64
+	Rects         []svgRect
+	Labels        []svgText
+}
+
+type htmlDay struct {
+	Date  string
+	Total string
+	Peak  string
+}
+
+type htmlPoint struct {
+	Id       string
+	Location string
+	Total    string
+	Min      string
+	Max      string
+	Avg      string
+	Peak     string
+	Days     []htmlDay
+	Daily    svgChart
+	Heatmap  svgChart
+}
+
+type htmlReport struct {
+	Title          string
+	Generated      string
+	Range          string
+	Customer       string
+	MeteringPoints []caruna.MeteringPoint
+	Points         []htmlPoint
+}
+
+func (self *HtmlOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	self.points = append(self.points, mps...)
+	return nil
+}
+
+func (self *HtmlOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	self.measurements = append(self.measurements, hms...)
+	return nil
+}
+
+func (self *HtmlOutput) Close() error {
+	report := &htmlReport{
+		Title:          "Energy consumption report",
+		Generated:      time.Now().In(self.loc).Format("2006-01-02 15:04 MST"),
+		MeteringPoints: self.points,
+	}
+	if self.query != nil {
+		report.Customer = self.query.Customer
+		if !self.query.Start.IsZero() {
+			report.Range = fmt.Sprintf("%s - %s",
+				self.query.Start.In(self.loc).Format("2006-01-02 15:04"),
+				self.query.Stop.In(self.loc).Format("2006-01-02 15:04"))
+		}
+		if report.MeteringPoints == nil {
+			report.MeteringPoints = self.query.MeteringPoints
+		}
+	}
+
+	for _, point := range GroupByMeteringPoint(self.measurements) {
+		p, err := self.pointReport(point)
+		if err != nil {
+			return err
+		}
+		report.Points = append(report.Points, p)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := htmlReportTemplate.Execute(buf, report); err != nil {
+		return err
+	}
+	_, err := self.w.Write(buf.Bytes())
+	return err
+}
+
+func (self *HtmlOutput) pointReport(point *Group) (htmlPoint, error) {
+	first := point.Measurements[0]
+	peak := point.Peak()
+	ret := htmlPoint{
+		Id:       point.Key,
+		Location: strings.Join(first.MeteringPointLocation, " "),
+		Total:    fmt.Sprintf("%.3f", point.Sum()),
+		Min:      fmt.Sprintf("%.3f", point.Min()),
+		Max:      fmt.Sprintf("%.3f", point.Max()),
+		Avg:      fmt.Sprintf("%.3f", point.Avg()),
+		Peak:     peak.Timestamp.In(self.loc).Format("2006-01-02 15:04"),
+	}
+
+	days, err := GroupByPeriod(point.Measurements, PeriodDay, self.loc)
+	if err != nil {
+		return ret, err
+	}
+	for _, d := range days {
+		ret.Days = append(ret.Days, htmlDay{
+			Date:  d.Key,
+			Total: fmt.Sprintf("%.3f", d.Sum()),
+			Peak:  d.Peak().Timestamp.In(self.loc).Format("15:04"),
+		})
+	}
+	ret.Daily = self.dailyChart(days)
+	ret.Heatmap = self.heatmapChart(days)
+	return ret, nil
+}
+
+// dailyChart draws one bar per day scaled to the largest day
+func (self *HtmlOutput) dailyChart(days []*Group) svgChart {
+	chart := svgChart{Width: htmlChartWidth, Height: htmlChartHeight}
+	plotW := float64(htmlChartWidth - htmlChartMargin)
+	plotH := float64(htmlChartHeight - htmlChartMargin)
+
+	max := 0.0
+	for _, d := range days {
+		max = math.Max(max, d.Sum())
+	}
+	if max <= 0 {
+		max = 1
+	}
+
+	slot := plotW / float64(len(days))
+	for i, d := range days {
+		h := d.Sum() / max * plotH
+		chart.Rects = append(chart.Rects, svgRect{
+			X:     float64(htmlChartMargin) + float64(i)*slot + slot*0.1,
+			Y:     plotH - h + 10,
+			W:     slot * 0.8,
+			H:     h,
+			Fill:  "#3b75af",
+			Title: fmt.Sprintf("%s: %.3f kWh", d.Key, d.Sum()),
+		})
+	}
+
+	// Axis labels: maximum and first / last day
+	chart.Labels = append(chart.Labels,
+		svgText{X: htmlChartMargin - 4, Y: 14, Anchor: "end", Text: fmt.Sprintf("%.0f", max)},
+		svgText{X: htmlChartMargin - 4, Y: plotH + 10, Anchor: "end", Text: "0"},
+		svgText{X: htmlChartMargin, Y: plotH + 28, Anchor: "start", Text: days[0].Key},
+		svgText{X: htmlChartWidth, Y: plotH + 28, Anchor: "end", Text: days[len(days)-1].Key},
+	)
+	return chart
+}
+
+// heatmapChart draws hours of day as rows and days as columns
+func (self *HtmlOutput) heatmapChart(days []*Group) svgChart {
+	chart := svgChart{
+		Width:  htmlChartWidth,
+		Height: float64(24*htmlHeatmapCellH + 30),
+	}
+	cellW := float64(htmlChartWidth-htmlChartMargin) / float64(len(days))
+
+	var cells [][24]float64
+	var present [][24]bool
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, d := range days {
+		var c [24]float64
+		var p [24]bool
+		for _, e := range d.Measurements {
+			h := e.Timestamp.In(self.loc).Hour()
+			c[h] += e.Value
+			p[h] = true
+		}
+		for h := 0; h < 24; h++ {
+			if p[h] {
+				min = math.Min(min, c[h])
+				max = math.Max(max, c[h])
+			}
+		}
+		cells = append(cells, c)
+		present = append(present, p)
+	}
+
+	for i, d := range days {
+		for h := 0; h < 24; h++ {
+			if !present[i][h] {
+				continue
+			}
+			f := 1.0
+			if max > min {
+				f = (cells[i][h] - min) / (max - min)
+			}
+			chart.Rects = append(chart.Rects, svgRect{
+				X:     float64(htmlChartMargin) + float64(i)*cellW,
+				Y:     float64(h * htmlHeatmapCellH),
+				W:     cellW,
+				H:     htmlHeatmapCellH,
+				Fill:  heatColor(f),
+				Title: fmt.Sprintf("%s %02d:00: %.3f kWh", d.Key, h, cells[i][h]),
+			})
+		}
+	}
+	for h := 0; h < 24; h += 6 {
+		chart.Labels = append(chart.Labels, svgText{
+			X: htmlChartMargin - 4, Y: float64(h*htmlHeatmapCellH + htmlHeatmapCellH), Anchor: "end",
+			Text: fmt.Sprintf("%02d", h),
+		})
+	}
+	chart.Labels = append(chart.Labels,
+		svgText{X: htmlChartMargin, Y: float64(24*htmlHeatmapCellH + 18), Anchor: "start", Text: days[0].Key},
+		svgText{X: htmlChartWidth, Y: float64(24*htmlHeatmapCellH + 18), Anchor: "end", Text: days[len(days)-1].Key},
+	)
+	return chart
+}
+
+// heatColor interpolates from light yellow (0) to dark red (1)
+func heatColor(f float64) string {
+	from := [3]float64{255, 255, 204}
+	to := [3]float64{189, 0, 38}
+	var c [3]int
+	for i := range c {
+		c[i] = int(from[i] + (to[i]-from[i])*f + 0.5)
+	}
+	return fmt.Sprintf("#%02x%02x%02x", c[0], c[1], c[2])
+}
+
+func NewHtmlOutput(w io.Writer, loc *time.Location, query *Query) *HtmlOutput {
+	return &HtmlOutput{w: w, loc: loc, query: query}
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+td.num { text-align: right; }
+svg text { font-size: 11px; fill: #444; }
+details { margin: 1em 0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}}{{if .Range}}, period {{.Range}}{{end}}{{if .Customer}}, customer {{.Customer}}{{end}}</p>
+{{if .MeteringPoints}}
+<h2>Metering points</h2>
+<table>
+<tr><th>Id</th><th>Location</th><th>Type</th><th>Hourly measured</th><th>Contract begin</th></tr>
+{{range .MeteringPoints}}<tr><td>{{.MeteringPointNumber}}</td><td>{{join .Location " "}}</td><td>{{.MeteringPointType}}</td><td>{{.HourlyMeasured}}</td><td>{{.Created}}</td></tr>
+{{end}}</table>
+{{end}}
+{{range .Points}}
+<h2>{{.Location}} ({{.Id}})</h2>
+<table>
+<tr><th>Total kWh</th><th>Min kWh/h</th><th>Max kWh/h</th><th>Avg kWh/h</th><th>Peak hour</th></tr>
+<tr><td class="num">{{.Total}}</td><td class="num">{{.Min}}</td><td class="num">{{.Max}}</td><td class="num">{{.Avg}}</td><td>{{.Peak}}</td></tr>
+</table>
+<h3>Daily totals</h3>
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Daily.Width}}" height="{{.Daily.Height}}">
+{{range .Daily.Rects}}<rect x="{{.X}}" y="{{.Y}}" width="{{.W}}" height="{{.H}}" fill="{{.Fill}}"><title>{{.Title}}</title></rect>
+{{end}}{{range .Daily.Labels}}<text x="{{.X}}" y="{{.Y}}" text-anchor="{{.Anchor}}">{{.Text}}</text>
+{{end}}</svg>
+<h3>Hour of day</h3>
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Heatmap.Width}}" height="{{.Heatmap.Height}}">
+{{range .Heatmap.Rects}}<rect x="{{.X}}" y="{{.Y}}" width="{{.W}}" height="{{.H}}" fill="{{.Fill}}"><title>{{.Title}}</title></rect>
+{{end}}{{range .Heatmap.Labels}}<text x="{{.X}}" y="{{.Y}}" text-anchor="{{.Anchor}}">{{.Text}}</text>
+{{end}}</svg>
+<details>
+<summary>Daily table</summary>
+<table>
+<tr><th>Date</th><th>kWh</th><th>Peak hour</th></tr>
+{{range .Days}}<tr><td>{{.Date}}</td><td class="num">{{.Total}}</td><td>{{.Peak}}</td></tr>
+{{end}}</table>
+</details>
+{{end}}
+</body>
+</html>
+`))
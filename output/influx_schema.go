@@ -0,0 +1,137 @@
+package output
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+// Values for InfluxSchema.PrimaryTag
+const (
+	PrimaryTagAddress = "address"
+	PrimaryTagId      = "id"
+	PrimaryTagAlias   = "alias"
+)
+
+// Tag keys for the optional metering point detail tags
+const (
+	TagStreet = "street"
+	TagZip    = "zip"
+	TagCity   = "city"
+	TagType   = "type"
+)
+
+// InfluxSchema maps measurements to InfluxDB measurement, tags and fields. It is shared
+// by all outputs that produce InfluxDB data so that they stay interchangeable.
+type InfluxSchema struct {
+	Measurement string
+	// Which metering point attribute is used as the value of the TagName tag
+	PrimaryTag string
+	// Metering point id to alias, used with PrimaryTagAlias
+	Aliases map[string]string
+	// Add street, zip, city and type tags
+	DetailTags bool
+	// Static tags added to every point
+	ExtraTags map[string]string
+
+	pointTypes map[string]string
+}
+
+// DefaultInfluxSchema is the schema gcaruna has always written
+func DefaultInfluxSchema() *InfluxSchema {
+	return &InfluxSchema{
+		Measurement: SeriesName,
+		PrimaryTag:  PrimaryTagAddress,
+	}
+}
+
+func (self *InfluxSchema) Validate() error {
+	switch self.PrimaryTag {
+	case PrimaryTagAddress, PrimaryTagId, PrimaryTagAlias:
+	default:
+		return fmt.Errorf("unknown primary tag: %s", self.PrimaryTag)
+	}
+	if self.Measurement == "" {
+		return fmt.Errorf("measurement name can't be empty")
+	}
+	for k := range self.ExtraTags {
+		switch k {
+		case TagName, TagStreet, TagZip, TagCity, TagType:
+			return fmt.Errorf("extra tag %s conflicts with a built-in tag", k)
+		}
+	}
+	return nil
+}
+
+// SetMeteringPoints makes metering point metadata such as the type available for tags
+func (self *InfluxSchema) SetMeteringPoints(mps []caruna.MeteringPoint) {
+	self.pointTypes = make(map[string]string)
+	for _, mp := range mps {
+		self.pointTypes[mp.MeteringPointNumber] = mp.MeteringPointType
+	}
+}
+
+// PrimaryTagValue identifies the metering point in the database
+func (self *InfluxSchema) PrimaryTagValue(e caruna.HourlyEnergyMeasurement) string {
+	switch self.PrimaryTag {
+	case PrimaryTagId:
+		return e.MeteringPointId
+	case PrimaryTagAlias:
+		if alias, ok := self.Aliases[e.MeteringPointId]; ok {
+			return alias
+		}
+		return e.MeteringPointId
+	}
+	return getMeteringPointName(e.MeteringPointLocation)
+}
+
+func (self *InfluxSchema) Tags(e caruna.HourlyEnergyMeasurement) map[string]string {
+	tags := make(map[string]string)
+	for k, v := range self.ExtraTags {
+		tags[k] = v
+	}
+	tags[TagName] = self.PrimaryTagValue(e)
+	if self.DetailTags {
+		if len(e.MeteringPointLocation) == 3 {
+			setTag(tags, TagStreet, e.MeteringPointLocation[0])
+			setTag(tags, TagZip, e.MeteringPointLocation[1])
+			setTag(tags, TagCity, e.MeteringPointLocation[2])
+		}
+		setTag(tags, TagType, self.pointTypes[e.MeteringPointId])
+	}
+	return tags
+}
+
+func (self *InfluxSchema) Fields(e caruna.HourlyEnergyMeasurement) map[string]interface{} {
+	fields := map[string]interface{}{
+		FieldName: e.Value,
+	}
+	if e.Status != "" {
+		fields[FieldStatus] = e.Status
+	}
+	return fields
+}
+
+// InfluxDB doesn't store empty tag values
+func setTag(tags map[string]string, k, v string) {
+	if v = strings.TrimSpace(v); v != "" {
+		tags[k] = v
+	}
+}
+
+// ParseKeyValues parses "k1=v1,k2=v2" lists used by the tag and alias options
+func ParseKeyValues(s string) (map[string]string, error) {
+	ret := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return ret, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Cannot parse key=value pair: %s", pair)
+		}
+		ret[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return ret, nil
+}
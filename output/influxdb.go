@@ -1,9 +1,16 @@
 package output
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -11,24 +18,62 @@ import (
 	influxdb "github.com/influxdb/influxdb/client/v2"
 )
 
+func init() {
+	Register("influxdb", func(opts *Options) (Output, error) {
+		if opts.InfluxDB == nil {
+			return nil, fmt.Errorf("influxdb output is not configured")
+		}
+		out, err := NewInfluxDBOutput(opts.InfluxDB)
+		if err != nil {
+			return nil, err
+		}
+		out.meta = opts.Query
+		if opts.Messages != nil {
+			out.messages = opts.Messages
+		}
+		if opts.Logger != nil {
+			out.SetLogger(opts.Logger)
+		}
+		return spool(opts, "influxdb", out, out.logger), nil
+	})
+}
+
 type InfluxDBConfig struct {
 	URL         string
 	Username    string
 	Password    string
 	Database    string
 	Incremental bool
+	Schema      *InfluxSchema
+	// Rewrite stored values that have changed within the trailing window
+	Reconcile       bool
+	ReconcileWindow time.Duration
+	// Write robustness
+	BatchSize       int
+	Retries         int
+	RetryDelay      time.Duration
+	RetentionPolicy string
+	CreateDatabase  bool
 }
 
+// Default schema
 const (
-	SeriesName = "gcaruna"
-	TagName = "meteringpoint"
-	FieldName  = "value"
+	SeriesName  = "gcaruna"
+	TagName     = "meteringpoint"
+	FieldName   = "value"
+	FieldStatus = "status"
 )
 
 type InfluxDBOutput struct {
-	logger *log.Logger
-	Client influxdb.Client
-	Config *InfluxDBConfig
+	logger   *log.Logger
+	messages io.Writer
+	// Client is used for queries, writes go through httpClient
+	Client     influxdb.Client
+	Config     *InfluxDBConfig
+	meta       *Query
+	httpClient *http.Client
+
+	databaseCreated bool
 }
 
 func (self *InfluxDBOutput) SetLogger(logger *log.Logger) {
@@ -36,112 +81,276 @@ func (self *InfluxDBOutput) SetLogger(logger *log.Logger) {
 	self.logger.SetPrefix("[InfluxDBOutput] ")
 }
 
+func (self *InfluxDBOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	return &ErrNotSupported{Output: "influxdb", Data: "metering points"}
+}
+
+func (self *InfluxDBOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	return self.WriteData(hms)
+}
+
+func (self *InfluxDBOutput) Close() error {
+	return self.Client.Close()
+}
+
 func (self *InfluxDBOutput) WriteData(hms []caruna.HourlyEnergyMeasurement) error {
 	self.logger.Println("Start WriteData")
-	// Timebounds for incremental runs
-	limitRanges := make(map[string][]time.Time)
+	schema := self.Config.Schema
+	if self.meta != nil {
+		schema.SetMeteringPoints(self.meta.MeteringPoints)
+	}
+	if self.Config.CreateDatabase && !self.databaseCreated {
+		if err := self.createDatabase(); err != nil {
+			return wrapError(err, "Cannot create database")
+		}
+	}
 
-	// Batch for points
-	bp, _ := influxdb.NewBatchPoints(influxdb.BatchPointsConfig{
-		Database: self.Config.Database,
-		Precision: "s",
-	})
+	// Existing points for incremental runs
+	var stored map[string]*storedPoints
+	if (self.Config.Incremental || self.Config.Reconcile) && len(hms) > 0 {
+		var err error
+		stored, err = self.storedPoints(schema, hms)
+		if err != nil {
+			return wrapError(err, "Cannot query stored points")
+		}
+	}
+	backfilled := make(map[string]int)
+	revised := make(map[string]int)
+	reconcileFrom := time.Now().Add(-self.Config.ReconcileWindow)
 
+	points := make([]string, 0, len(hms))
 	for _, e := range hms {
-		meteringPointName := getMeteringPointName(e.MeteringPointLocation)
-
-		limitRange, limitRangeFound := limitRanges[meteringPointName]
-		var limitStart, limitStop time.Time
-		if limitRangeFound && limitRange != nil {
-			limitStart = limitRange[0]
-			limitStop = limitRange[1]
-		} else {
-			// By default the time range is now to now
-			limitStart = time.Now()
-			limitStop = time.Now()
-		}
-
-		// Query for ranges if incremental run is requested
-		if self.Config.Incremental && !limitRangeFound {
-			q := fmt.Sprintf(`SELECT * FROM "%s" WHERE %s='%s' ORDER BY time ASC LIMIT 1`, SeriesName, TagName, meteringPointName)
-			res, err := self.query(q)
-			if err != nil {
-				return err
-			}
-			if len(res[0].Series) > 0 {
-				val, _ := time.Parse(time.RFC3339, res[0].Series[0].Values[0][0].(string))
-				limitStart = val
-
-				q = fmt.Sprintf(`SELECT * FROM "%s" WHERE %s='%s' ORDER BY time DESC LIMIT 1`, SeriesName, TagName, meteringPointName)
-				res, err = self.query(q)
-				if err != nil {
-					return err
+		// Skip measurements that are already stored (incremental mode)
+		// unless they have been revised (reconcile mode)
+		name := schema.PrimaryTagValue(e)
+		if sp, ok := stored[name]; ok {
+			if sv, found := sp.values[e.Timestamp.Unix()]; found {
+				if self.Config.Reconcile && !e.Timestamp.Before(reconcileFrom) && sv.changed(e) {
+					revised[name]++
+				} else if self.Config.Incremental {
+					continue
 				}
-				val, _ = time.Parse(time.RFC3339, res[0].Series[0].Values[0][0].(string))
-				limitStop = val
-
-				// Cache ranges
-				limitRanges[meteringPointName] = []time.Time{limitStart, limitStop}
-				self.logger.Printf("Meteringpoint %s: excluding range %s - %s", meteringPointName, limitStart.String(), limitStop.String())
-			} else {
-				self.logger.Printf("No existing time range for meteringpoint: %s", meteringPointName)
-				limitRanges[meteringPointName] = nil
+			} else if e.Timestamp.After(sp.first) && e.Timestamp.Before(sp.last) {
+				// Missing hour inside the stored range
+				backfilled[name]++
 			}
-		} // query time ranges
-
-		// Skip measurements that are in the limit range (incremental mode)
-		mts := e.Timestamp
-		if self.Config.Incremental &&
-			(mts.Equal(limitStart) || mts.After(limitStart)) &&
-			(mts.Equal(limitStop) || mts.Before(limitStop)) {
-
-			continue
 		}
 
 		// Make influxdb point
-		tags := map[string]string{
-			"meteringpoint": meteringPointName,
-		}
-		fields := map[string]interface{}{
-			FieldName: e.Value,
-		}
-		pt, err := influxdb.NewPoint(
-			SeriesName,
-			tags,
-			fields,
-			e.Timestamp,
-		)
+		pt, err := lineProtocol(schema.Measurement, schema.Tags(e), schema.Fields(e), e.Timestamp)
 		if err != nil {
 			return err
 		}
-		bp.AddPoint(pt)
+		points = append(points, pt)
 	} // range hms
 
+	// Large backfills are split into batches that are retried separately
+	batchSize := self.Config.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(points)
+	}
+	for i := 0; i < len(points); i += batchSize {
+		end := i + batchSize
+		if end > len(points) {
+			end = len(points)
+		}
+		body := strings.Join(points[i:end], "\n") + "\n"
+		err := retry(self.Config.Retries, self.Config.RetryDelay, self.logger, func() error {
+			return self.write(body)
+		})
+		if err != nil {
+			return wrapError(err, "Cannot write points %d-%d of %d", i+1, end, len(points))
+		}
+	}
+
+	for name, n := range backfilled {
+		fmt.Fprintf(self.messages, "Meteringpoint %s: backfilled %d missing hours\n", name, n)
+	}
+	for name, n := range revised {
+		fmt.Fprintf(self.messages, "Meteringpoint %s: rewrote %d revised values\n", name, n)
+	}
+	self.logger.Printf("Wrote %d data points to DB\n", len(points))
+	return nil
+}
 
-	if err := self.Client.Write(bp); err != nil {
+// write posts line protocol to /write. The client library doesn't tell the http
+// status of a failed write, which retry needs.
+func (self *InfluxDBOutput) write(body string) error {
+	params := url.Values{}
+	params.Set("db", self.Config.Database)
+	if self.Config.RetentionPolicy != "" {
+		params.Set("rp", self.Config.RetentionPolicy)
+	}
+	params.Set("precision", "s")
+	req, err := http.NewRequest("POST", strings.TrimRight(self.Config.URL, "/")+"/write?"+params.Encode(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if self.Config.Username != "" {
+		req.SetBasicAuth(self.Config.Username, self.Config.Password)
+	}
+	resp, err := self.httpClient.Do(req)
+	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{code: resp.StatusCode, status: resp.Status, msg: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
 
-	self.logger.Printf("Wrote %d data points to DB\n", len(bp.Points()))
+func (self *InfluxDBOutput) createDatabase() error {
+	err := retry(self.Config.Retries, self.Config.RetryDelay, self.logger, func() error {
+		_, err := self.query("CREATE DATABASE " + quoteIdent(self.Config.Database))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	self.databaseCreated = true
 	return nil
 }
 
-func (self *InfluxDBOutput) query(cmd string) (res []influxdb.Result, err error) {
-    q := influxdb.Query{
-        Command:  cmd,
-        Database: self.Config.Database,
-    }
-    if response, err := self.Client.Query(q); err == nil {
-        if response.Error() != nil {
-            return res, response.Error()
-        }
-        res = response.Results
-    }
-    return res, nil
+// from returns the measurement, qualified with the retention policy if one is set
+func (self *InfluxDBOutput) from(measurement string) string {
+	if self.Config.RetentionPolicy == "" {
+		return quoteIdent(measurement)
+	}
+	return quoteIdent(self.Config.RetentionPolicy) + "." + quoteIdent(measurement)
+}
+
+// Value and status of a stored point
+type storedValue struct {
+	value  float64
+	status string
+}
+
+// Points written before the status field existed have an unknown status,
+// only the value is compared for them
+func (self storedValue) changed(e caruna.HourlyEnergyMeasurement) bool {
+	if math.Abs(self.value-e.Value) > 1e-9 {
+		return true
+	}
+	return self.status != "" && self.status != e.Status
+}
+
+// Points already stored for a metering point
+type storedPoints struct {
+	values      map[int64]storedValue
+	first, last time.Time
+}
+
+func (self *storedPoints) add(t time.Time, v storedValue) {
+	self.values[t.Unix()] = v
+	if self.first.IsZero() || t.Before(self.first) {
+		self.first = t
+	}
+	if t.After(self.last) {
+		self.last = t
+	}
+}
+
+// storedPoints returns the stored points for each metering point of the given
+// measurements within their time range
+func (self *InfluxDBOutput) storedPoints(schema *InfluxSchema, hms []caruna.HourlyEnergyMeasurement) (map[string]*storedPoints, error) {
+	start, stop := timeBounds(hms)
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range hms {
+		name := schema.PrimaryTagValue(e)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, quoteIdent(TagName)+" = "+quoteString(name))
+		}
+	}
+	sort.Strings(names)
+	q := fmt.Sprintf("SELECT %s, %s FROM %s WHERE (%s) AND time >= '%s' AND time <= '%s' GROUP BY %s",
+		quoteIdent(FieldName), quoteIdent(FieldStatus), self.from(schema.Measurement), strings.Join(names, " OR "),
+		start.UTC().Format(time.RFC3339), stop.UTC().Format(time.RFC3339), quoteIdent(TagName))
+	res, err := self.query(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 1 {
+		return nil, fmt.Errorf("expected 1 result, got %d", len(res))
+	}
+	if res[0].Err != nil {
+		return nil, res[0].Err
+	}
+
+	ret := make(map[string]*storedPoints)
+	for _, row := range res[0].Series {
+		name := row.Tags[TagName]
+		sp, ok := ret[name]
+		if !ok {
+			sp = &storedPoints{values: make(map[int64]storedValue)}
+			ret[name] = sp
+		}
+		valCol, statusCol := -1, -1
+		for i, c := range row.Columns {
+			switch c {
+			case FieldName:
+				valCol = i
+			case FieldStatus:
+				statusCol = i
+			}
+		}
+		for _, v := range row.Values {
+			if len(v) == 0 {
+				continue
+			}
+			ts, ok := v[0].(string)
+			if !ok {
+				return nil, fmt.Errorf("unexpected time value: %v", v[0])
+			}
+			t, err := time.Parse(time.RFC3339, ts)
+			if err != nil {
+				return nil, err
+			}
+			var sv storedValue
+			if valCol != -1 && valCol < len(v) {
+				if sv.value, err = toFloat(v[valCol]); err != nil {
+					return nil, err
+				}
+			}
+			if statusCol != -1 && statusCol < len(v) {
+				sv.status, _ = v[statusCol].(string)
+			}
+			sp.add(t, sv)
+		}
+	}
+	for name, sp := range ret {
+		self.logger.Printf("Meteringpoint %s: %d hours stored between %s - %s", name, len(sp.values), sp.first, sp.last)
+	}
+	return ret, nil
+}
+
+func (self *InfluxDBOutput) query(cmd string) ([]influxdb.Result, error) {
+	q := influxdb.Query{
+		Command:  cmd,
+		Database: self.Config.Database,
+	}
+	response, err := self.Client.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	if response.Error() != nil {
+		return nil, response.Error()
+	}
+	return response.Results, nil
 }
 
 func NewInfluxDBOutput(config *InfluxDBConfig) (*InfluxDBOutput, error) {
 	var err error
+	if config.Schema == nil {
+		config.Schema = DefaultInfluxSchema()
+	}
+	if err := config.Schema.Validate(); err != nil {
+		return nil, err
+	}
 	clientCfg := influxdb.HTTPConfig{
 		Addr:     config.URL,
 		Username: config.Username,
@@ -153,13 +362,54 @@ func NewInfluxDBOutput(config *InfluxDBConfig) (*InfluxDBOutput, error) {
 	}
 
 	ret := &InfluxDBOutput{
-		Client: client,
-		Config: config,
+		Client:     client,
+		Config:     config,
+		messages:   os.Stderr,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
 	}
 	ret.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
 	return ret, nil
 }
 
+// timeBounds returns the first and last timestamp of non-empty measurements
+func timeBounds(hms []caruna.HourlyEnergyMeasurement) (start, stop time.Time) {
+	start, stop = hms[0].Timestamp, hms[0].Timestamp
+	for _, e := range hms {
+		if e.Timestamp.Before(start) {
+			start = e.Timestamp
+		}
+		if e.Timestamp.After(stop) {
+			stop = e.Timestamp
+		}
+	}
+	return start, stop
+}
+
+// Query results are decoded either as float64 or json.Number
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case json.Number:
+		return n.Float64()
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unexpected value: %v", v)
+}
+
+// quoteIdent quotes an InfluxQL identifier
+func quoteIdent(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// quoteString quotes an InfluxQL string literal
+func quoteString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
 func getMeteringPointName(loc []string) string {
 	ret := strings.Join(loc, "_")
 	ret = strings.Replace(ret, " ", "_", -1)
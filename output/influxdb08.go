@@ -0,0 +1,201 @@
+package output
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+	influxdb08 "github.com/aakso/gcaruna/influxdb08"
+)
+
+func init() {
+	Register("influxdb08", func(opts *Options) (Output, error) {
+		if opts.InfluxDB08 == nil {
+			return nil, fmt.Errorf("influxdb08 output is not configured")
+		}
+		out, err := NewInfluxDB08Output(opts.InfluxDB08)
+		if err != nil {
+			return nil, err
+		}
+		out.meta = opts.Query
+		if opts.Logger != nil {
+			out.SetLogger(opts.Logger)
+		}
+		return spool(opts, "influxdb08", out, out.logger), nil
+	})
+}
+
+type InfluxDB08Config struct {
+	Host        string
+	Username    string
+	Password    string
+	Database    string
+	IsSecure    bool
+	Incremental bool
+	Schema      *InfluxSchema
+}
+
+// InfluxDB08Output writes to InfluxDB 0.8 which has no tags. Each metering point
+// gets its own series named <measurement>.<meteringpoint> and the remaining tags
+// are stored as columns.
+type InfluxDB08Output struct {
+	logger *log.Logger
+	Client *influxdb08.Client
+	Config *InfluxDB08Config
+	meta   *Query
+}
+
+func (self *InfluxDB08Output) SetLogger(logger *log.Logger) {
+	self.logger = logger
+	self.logger.SetPrefix("[InfluxDB08Output] ")
+}
+
+func (self *InfluxDB08Output) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	return &ErrNotSupported{Output: "influxdb08", Data: "metering points"}
+}
+
+func (self *InfluxDB08Output) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	return self.WriteData(hms)
+}
+
+func (self *InfluxDB08Output) Close() error {
+	return nil
+}
+
+func (self *InfluxDB08Output) WriteData(hms []caruna.HourlyEnergyMeasurement) error {
+	self.logger.Println("Start WriteData")
+	schema := self.Config.Schema
+	if self.meta != nil {
+		schema.SetMeteringPoints(self.meta.MeteringPoints)
+	}
+
+	// Timebounds for incremental runs
+	var limitRanges map[string][2]time.Time
+	if self.Config.Incremental {
+		var err error
+		limitRanges, err = self.storedRanges(schema.Measurement)
+		if err != nil {
+			return wrapError(err, "Cannot query stored time ranges")
+		}
+	}
+
+	var series []*influxdb08.Series
+	seriesIndex := make(map[string]*influxdb08.Series)
+	count := 0
+	for _, e := range hms {
+		// Skip measurements that are in the limit range (incremental mode)
+		name := self.seriesName(schema.PrimaryTagValue(e))
+		if limitRange, ok := limitRanges[name]; ok &&
+			!e.Timestamp.Before(limitRange[0]) && !e.Timestamp.After(limitRange[1]) {
+
+			continue
+		}
+
+		// Tags other than the metering point become columns
+		tags := schema.Tags(e)
+		delete(tags, TagName)
+		tagKeys := make([]string, 0, len(tags))
+		for k := range tags {
+			tagKeys = append(tagKeys, k)
+		}
+		sort.Strings(tagKeys)
+		columns := append([]string{"time", FieldName, FieldStatus}, tagKeys...)
+		point := []interface{}{e.Timestamp.Unix(), e.Value, e.Status}
+		for _, k := range tagKeys {
+			point = append(point, tags[k])
+		}
+
+		key := name + "\x00" + strings.Join(columns, "\x00")
+		s, ok := seriesIndex[key]
+		if !ok {
+			s = &influxdb08.Series{Name: name, Columns: columns}
+			seriesIndex[key] = s
+			series = append(series, s)
+		}
+		s.Points = append(s.Points, point)
+		count++
+	}
+	if count == 0 {
+		self.logger.Println("No new data points to write")
+		return nil
+	}
+
+	if err := self.Client.WriteSeriesWithTimePrecision(series, influxdb08.Second); err != nil {
+		return err
+	}
+	self.logger.Printf("Wrote %d data points to DB\n", count)
+	return nil
+}
+
+func (self *InfluxDB08Output) seriesName(meteringPoint string) string {
+	return self.Config.Schema.Measurement + "." + meteringPoint
+}
+
+// storedRanges returns the first and last stored timestamp for each series
+func (self *InfluxDB08Output) storedRanges(measurement string) (map[string][2]time.Time, error) {
+	// Regexp queries return one point per matching series
+	re := "/^" + strings.Replace(regexp.QuoteMeta(measurement+"."), "/", `\/`, -1) + "/"
+	ret := make(map[string][2]time.Time)
+	for i, order := range []string{"asc", "desc"} {
+		q := fmt.Sprintf("select %s from %s order %s limit 1", FieldName, re, order)
+		res, err := self.Client.Query(q, influxdb08.Second)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range res {
+			timeCol := -1
+			for j, c := range s.Columns {
+				if c == "time" {
+					timeCol = j
+				}
+			}
+			if timeCol == -1 || len(s.Points) == 0 || timeCol >= len(s.Points[0]) {
+				continue
+			}
+			sec, ok := s.Points[0][timeCol].(float64)
+			if !ok {
+				return nil, fmt.Errorf("unexpected time value: %v", s.Points[0][timeCol])
+			}
+			limitRange := ret[s.Name]
+			limitRange[i] = time.Unix(int64(sec), 0).UTC()
+			ret[s.Name] = limitRange
+		}
+	}
+	for name, limitRange := range ret {
+		self.logger.Printf("Series %s: excluding range %s - %s", name, limitRange[0], limitRange[1])
+	}
+	return ret, nil
+}
+
+func NewInfluxDB08Output(config *InfluxDB08Config) (*InfluxDB08Output, error) {
+	if config.Database == "" {
+		return nil, fmt.Errorf("influxdb08 output needs a database")
+	}
+	if config.Schema == nil {
+		config.Schema = DefaultInfluxSchema()
+	}
+	if err := config.Schema.Validate(); err != nil {
+		return nil, err
+	}
+	client, err := influxdb08.NewClient(&influxdb08.ClientConfig{
+		Host:     config.Host,
+		Username: config.Username,
+		Password: config.Password,
+		Database: config.Database,
+		IsSecure: config.IsSecure,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := &InfluxDB08Output{
+		Client: client,
+		Config: config,
+	}
+	ret.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	return ret, nil
+}
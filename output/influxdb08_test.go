@@ -0,0 +1,113 @@
+package output
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	influxdb08 "github.com/aakso/gcaruna/influxdb08"
+)
+
+// influx08Stub serves /db/<db>/series, GET for queries and POST for writes
+type influx08Stub struct {
+	*httptest.Server
+	stored  map[string][2]int64 // first and last stored second per series
+	queries []string
+	writes  []*influxdb08.Series
+	errors  []string
+}
+
+func newInflux08Stub() *influx08Stub {
+	stub := &influx08Stub{stored: make(map[string][2]int64)}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/db/energy/series" {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("time_precision") != "s" {
+			stub.errors = append(stub.errors, "time_precision="+q.Get("time_precision"))
+		}
+		switch r.Method {
+		case "GET":
+			stub.queries = append(stub.queries, q.Get("q"))
+			i := 0
+			if strings.Contains(q.Get("q"), "order desc") {
+				i = 1
+			}
+			var res []*influxdb08.Series
+			for name, limits := range stub.stored {
+				res = append(res, &influxdb08.Series{
+					Name:    name,
+					Columns: []string{"time", "sequence_number", FieldName},
+					Points:  [][]interface{}{{limits[i], 1, 1.5}},
+				})
+			}
+			json.NewEncoder(w).Encode(res)
+		case "POST":
+			var series []*influxdb08.Series
+			if err := json.NewDecoder(r.Body).Decode(&series); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			stub.writes = append(stub.writes, series...)
+		}
+	}))
+	return stub
+}
+
+func testInfluxDB08Output(t *testing.T, url string) *InfluxDB08Output {
+	out, err := NewInfluxDB08Output(&InfluxDB08Config{
+		Host:        strings.TrimPrefix(url, "http://"),
+		Database:    "energy",
+		Incremental: true,
+		Schema:      &InfluxSchema{Measurement: SeriesName, PrimaryTag: PrimaryTagId},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestInfluxDB08Incremental(t *testing.T) {
+	stub := newInflux08Stub()
+	defer stub.Close()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stub.stored["gcaruna.mp1"] = [2]int64{start.Add(time.Hour).Unix(), start.Add(2 * time.Hour).Unix()}
+	out := testInfluxDB08Output(t, stub.URL)
+
+	hms := append(testMeasurements("mp1", start, 4), testMeasurements("mp2", start, 1)...)
+	if err := out.WriteData(hms); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.errors) != 0 {
+		t.Errorf("unexpected requests: %v", stub.errors)
+	}
+	want := []string{
+		`select value from /^gcaruna\./ order asc limit 1`,
+		`select value from /^gcaruna\./ order desc limit 1`,
+	}
+	if strings.Join(stub.queries, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected queries %q, got %q", want, stub.queries)
+	}
+
+	// Hours 1 and 2 of mp1 are within the stored range
+	written := make(map[string][]int64)
+	for _, s := range stub.writes {
+		if s.Columns[0] != "time" || s.Columns[1] != FieldName || s.Columns[2] != FieldStatus {
+			t.Errorf("unexpected columns: %v", s.Columns)
+		}
+		for _, p := range s.Points {
+			written[s.Name] = append(written[s.Name], int64(p[0].(float64)))
+		}
+	}
+	if got := written["gcaruna.mp1"]; len(got) != 2 || got[0] != start.Unix() || got[1] != start.Add(3*time.Hour).Unix() {
+		t.Errorf("unexpected mp1 points: %v", got)
+	}
+	if got := written["gcaruna.mp2"]; len(got) != 1 || got[0] != start.Unix() {
+		t.Errorf("unexpected mp2 points: %v", got)
+	}
+}
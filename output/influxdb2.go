@@ -0,0 +1,341 @@
+package output
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+func init() {
+	Register("influxdb2", func(opts *Options) (Output, error) {
+		if opts.InfluxDB2 == nil {
+			return nil, fmt.Errorf("influxdb2 output is not configured")
+		}
+		out, err := NewInfluxDB2Output(opts.InfluxDB2)
+		if err != nil {
+			return nil, err
+		}
+		out.meta = opts.Query
+		if opts.Logger != nil {
+			out.SetLogger(opts.Logger)
+		}
+		return spool(opts, "influxdb2", out, out.logger), nil
+	})
+}
+
+// Query languages for incremental checks
+const (
+	InfluxQueryFlux = "flux" // InfluxDB 2.x
+	InfluxQuerySQL  = "sql"  // InfluxDB 3.x
+)
+
+type InfluxDB2Config struct {
+	URL           string
+	Token         string
+	Org           string
+	Bucket        string
+	QueryLanguage string
+	Incremental   bool
+	Schema        *InfluxSchema
+}
+
+// InfluxDB2Output writes line protocol to the /api/v2/write endpoint which is
+// provided by both InfluxDB 2.x and 3.x
+type InfluxDB2Output struct {
+	logger *log.Logger
+	Client *http.Client
+	Config *InfluxDB2Config
+	meta   *Query
+}
+
+func (self *InfluxDB2Output) SetLogger(logger *log.Logger) {
+	self.logger = logger
+	self.logger.SetPrefix("[InfluxDB2Output] ")
+}
+
+func (self *InfluxDB2Output) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	return &ErrNotSupported{Output: "influxdb2", Data: "metering points"}
+}
+
+func (self *InfluxDB2Output) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	return self.WriteData(hms)
+}
+
+func (self *InfluxDB2Output) Close() error {
+	return nil
+}
+
+func (self *InfluxDB2Output) WriteData(hms []caruna.HourlyEnergyMeasurement) error {
+	self.logger.Println("Start WriteData")
+	schema := self.Config.Schema
+	if self.meta != nil {
+		schema.SetMeteringPoints(self.meta.MeteringPoints)
+	}
+
+	// Existing points for incremental runs
+	var stored map[string]map[int64]bool
+	if self.Config.Incremental && len(hms) > 0 {
+		var err error
+		stored, err = self.storedTimes(schema.Measurement, hms)
+		if err != nil {
+			return wrapError(err, "Cannot query stored points")
+		}
+	}
+
+	var buf bytes.Buffer
+	count := 0
+	for _, e := range hms {
+		if stored[schema.PrimaryTagValue(e)][e.Timestamp.Unix()] {
+			continue
+		}
+		line, err := lineProtocol(schema.Measurement, schema.Tags(e), schema.Fields(e), e.Timestamp)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		count++
+	}
+	if count == 0 {
+		self.logger.Println("No new data points to write")
+		return nil
+	}
+
+	params := url.Values{}
+	params.Set("org", self.Config.Org)
+	params.Set("bucket", self.Config.Bucket)
+	params.Set("precision", "s")
+	resp, err := self.post("/api/v2/write", params, "text/plain; charset=utf-8", "Token", &buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	self.logger.Printf("Wrote %d data points to bucket %s\n", count, self.Config.Bucket)
+	return nil
+}
+
+// storedTimes returns the stored timestamps for each metering point within the
+// time range of the given measurements
+func (self *InfluxDB2Output) storedTimes(measurement string, hms []caruna.HourlyEnergyMeasurement) (map[string]map[int64]bool, error) {
+	start, stop := timeBounds(hms)
+	ret := make(map[string]map[int64]bool)
+	add := func(name string, t time.Time) {
+		if ret[name] == nil {
+			ret[name] = make(map[int64]bool)
+		}
+		ret[name][t.Unix()] = true
+	}
+
+	var err error
+	switch self.Config.QueryLanguage {
+	case InfluxQueryFlux:
+		err = self.queryFlux(measurement, start, stop, add)
+	case InfluxQuerySQL:
+		err = self.querySQL(measurement, start, stop, add)
+	default:
+		err = fmt.Errorf("unknown query language: %s", self.Config.QueryLanguage)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, times := range ret {
+		self.logger.Printf("Meteringpoint %s: %d hours already stored", name, len(times))
+	}
+	return ret, nil
+}
+
+func (self *InfluxDB2Output) queryFlux(measurement string, start, stop time.Time, add func(string, time.Time)) error {
+	// Range stop is exclusive
+	q := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: %s, stop: %s)
+  |> filter(fn: (r) => r._measurement == %s and r._field == %s)
+  |> keep(columns: ["_time", %s])`,
+		fluxString(self.Config.Bucket),
+		start.UTC().Format(time.RFC3339), stop.Add(time.Second).UTC().Format(time.RFC3339),
+		fluxString(measurement), fluxString(FieldName), fluxString(TagName))
+
+	params := url.Values{}
+	params.Set("org", self.Config.Org)
+	resp, err := self.post("/api/v2/query", params, "application/vnd.flux", "Token", strings.NewReader(q))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The result is CSV with a header row for each table
+	cr := csv.NewReader(resp.Body)
+	cr.FieldsPerRecord = -1
+	timeCol, tagCol, errCol := -1, -1, -1
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		// Annotation rows
+		if len(rec) > 0 && strings.HasPrefix(rec[0], "#") {
+			continue
+		}
+		if i := columnIndex(rec, "_time"); i != -1 {
+			timeCol, tagCol = i, columnIndex(rec, TagName)
+			continue
+		}
+		if i := columnIndex(rec, "error"); i != -1 {
+			errCol = i
+			continue
+		}
+		if errCol != -1 && errCol < len(rec) {
+			return fmt.Errorf("flux query failed: %s", rec[errCol])
+		}
+		if timeCol == -1 || tagCol == -1 || timeCol >= len(rec) || tagCol >= len(rec) {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, rec[timeCol])
+		if err != nil {
+			return err
+		}
+		add(rec[tagCol], t)
+	}
+	return nil
+}
+
+func (self *InfluxDB2Output) querySQL(measurement string, start, stop time.Time, add func(string, time.Time)) error {
+	q := fmt.Sprintf("SELECT time, %s FROM %s WHERE time >= '%s' AND time <= '%s'",
+		sqlIdent(TagName), sqlIdent(measurement),
+		start.UTC().Format(time.RFC3339), stop.UTC().Format(time.RFC3339))
+	body, err := json.Marshal(map[string]string{
+		"db":     self.Config.Bucket,
+		"q":      q,
+		"format": "json",
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := self.post("/api/v3/query_sql", nil, "application/json", "Bearer", bytes.NewReader(body))
+	if err != nil {
+		// Nothing has been written yet
+		if sqlNotFound(err) {
+			self.logger.Printf("No stored data: %s", err)
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	var rows []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return fmt.Errorf("Cannot parse query response: %s", err)
+	}
+	for _, row := range rows {
+		ts, _ := row["time"].(string)
+		name, _ := row[TagName].(string)
+		t, err := parseSQLTime(ts)
+		if err != nil {
+			return err
+		}
+		add(name, t)
+	}
+	return nil
+}
+
+func (self *InfluxDB2Output) post(path string, params url.Values, contentType, authScheme string, body io.Reader) (*http.Response, error) {
+	u := strings.TrimRight(self.Config.URL, "/") + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if self.Config.Token != "" {
+		req.Header.Set("Authorization", authScheme+" "+self.Config.Token)
+	}
+	resp, err := self.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, &statusError{code: resp.StatusCode, status: resp.Status, path: path, msg: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
+
+// InfluxDB 3.x reports a missing table or database until the first write
+var sqlNotFoundRe = regexp.MustCompile(`database not found|table '[^']*' not found`)
+
+func sqlNotFound(err error) bool {
+	se, ok := err.(*statusError)
+	return ok && sqlNotFoundRe.MatchString(se.msg)
+}
+
+func NewInfluxDB2Output(config *InfluxDB2Config) (*InfluxDB2Output, error) {
+	if config.URL == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("influxdb2 output needs an url and a bucket")
+	}
+	if config.QueryLanguage == "" {
+		config.QueryLanguage = InfluxQueryFlux
+	}
+	if config.QueryLanguage != InfluxQueryFlux && config.QueryLanguage != InfluxQuerySQL {
+		return nil, fmt.Errorf("unknown query language: %s", config.QueryLanguage)
+	}
+	if config.QueryLanguage == InfluxQueryFlux && config.Org == "" {
+		return nil, fmt.Errorf("influxdb2 output needs an org for flux queries")
+	}
+	if config.Schema == nil {
+		config.Schema = DefaultInfluxSchema()
+	}
+	if err := config.Schema.Validate(); err != nil {
+		return nil, err
+	}
+	ret := &InfluxDB2Output{
+		Client: &http.Client{Timeout: 60 * time.Second},
+		Config: config,
+	}
+	ret.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	return ret, nil
+}
+
+func columnIndex(header []string, name string) int {
+	for i, h := range header {
+		if h == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// fluxString quotes a Flux string literal
+func fluxString(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`).Replace(s)
+	return `"` + s + `"`
+}
+
+// sqlIdent quotes an SQL identifier
+func sqlIdent(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// InfluxDB 3.x returns timestamps without a zone, they are in UTC
+func parseSQLTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02T15:04:05.999999999", s)
+}
@@ -0,0 +1,209 @@
+package output
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// influx2Request is a request received by influx2Stub
+type influx2Request struct {
+	Path        string
+	Query       string
+	Auth        string
+	ContentType string
+	Body        string
+}
+
+// influx2Stub answers queries with a canned response and records all requests
+type influx2Stub struct {
+	*httptest.Server
+	status   int
+	response string
+	requests []influx2Request
+}
+
+func newInflux2Stub() *influx2Stub {
+	stub := &influx2Stub{status: http.StatusOK}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		stub.requests = append(stub.requests, influx2Request{
+			Path:        r.URL.Path,
+			Query:       r.URL.RawQuery,
+			Auth:        r.Header.Get("Authorization"),
+			ContentType: r.Header.Get("Content-Type"),
+			Body:        string(body),
+		})
+		switch r.URL.Path {
+		case "/api/v2/write":
+			w.WriteHeader(http.StatusNoContent)
+		case "/api/v2/query", "/api/v3/query_sql":
+			w.WriteHeader(stub.status)
+			w.Write([]byte(stub.response))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return stub
+}
+
+// writes returns the bodies of the write requests
+func (self *influx2Stub) writes() []string {
+	var ret []string
+	for _, r := range self.requests {
+		if r.Path == "/api/v2/write" {
+			ret = append(ret, r.Body)
+		}
+	}
+	return ret
+}
+
+func testInfluxDB2Output(t *testing.T, url, language string, incremental bool) *InfluxDB2Output {
+	out, err := NewInfluxDB2Output(&InfluxDB2Config{
+		URL:           url,
+		Token:         "secret",
+		Org:           "home",
+		Bucket:        "energy",
+		QueryLanguage: language,
+		Incremental:   incremental,
+		Schema:        &InfluxSchema{Measurement: SeriesName, PrimaryTag: PrimaryTagId},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestInfluxDB2Write(t *testing.T) {
+	stub := newInflux2Stub()
+	defer stub.Close()
+	out := testInfluxDB2Output(t, stub.URL, InfluxQueryFlux, false)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := out.WriteData(testMeasurements("mp1", start, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(stub.requests))
+	}
+	req := stub.requests[0]
+	if req.Path != "/api/v2/write" || req.Query != "bucket=energy&org=home&precision=s" {
+		t.Errorf("unexpected write request: %s?%s", req.Path, req.Query)
+	}
+	if req.Auth != "Token secret" {
+		t.Errorf("unexpected Authorization header: %q", req.Auth)
+	}
+	want := "gcaruna,meteringpoint=mp1 status=\"OK\",value=1.5 1704067200\n" +
+		"gcaruna,meteringpoint=mp1 status=\"OK\",value=1.5 1704070800\n"
+	if req.Body != want {
+		t.Errorf("expected body %q, got %q", want, req.Body)
+	}
+}
+
+func TestInfluxDB2Flux(t *testing.T) {
+	stub := newInflux2Stub()
+	defer stub.Close()
+	stub.response = "#datatype,string,long,dateTime:RFC3339,string\r\n" +
+		"#group,false,false,false,true\r\n" +
+		"#default,_result,,,\r\n" +
+		",result,table,_time,meteringpoint\r\n" +
+		",,0,2024-01-01T00:00:00Z,mp1\r\n" +
+		",,0,2024-01-01T01:00:00Z,mp1\r\n" +
+		"\r\n"
+	out := testInfluxDB2Output(t, stub.URL, InfluxQueryFlux, true)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := out.WriteData(testMeasurements("mp1", start, 3)); err != nil {
+		t.Fatal(err)
+	}
+	req := stub.requests[0]
+	if req.Path != "/api/v2/query" || req.Query != "org=home" {
+		t.Errorf("unexpected query request: %s?%s", req.Path, req.Query)
+	}
+	if req.Auth != "Token secret" || req.ContentType != "application/vnd.flux" {
+		t.Errorf("unexpected query headers: %q, %q", req.Auth, req.ContentType)
+	}
+	if !strings.HasPrefix(req.Body, `from(bucket: "energy")`) {
+		t.Errorf("unexpected flux query: %s", req.Body)
+	}
+	writes := stub.writes()
+	if len(writes) != 1 || strings.Count(writes[0], "\n") != 1 || !strings.HasSuffix(writes[0], " 1704074400\n") {
+		t.Errorf("expected only the third hour to be written, got %q", writes)
+	}
+}
+
+func TestInfluxDB2FluxError(t *testing.T) {
+	stub := newInflux2Stub()
+	defer stub.Close()
+	stub.response = "#datatype,string,string\r\n" +
+		"#group,true,true\r\n" +
+		"#default,,\r\n" +
+		",error,reference\r\n" +
+		",bucket not found,\r\n"
+	out := testInfluxDB2Output(t, stub.URL, InfluxQueryFlux, true)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := out.WriteData(testMeasurements("mp1", start, 3))
+	if err == nil || !strings.Contains(err.Error(), "bucket not found") {
+		t.Fatalf("expected flux query error, got %v", err)
+	}
+}
+
+func TestInfluxDB2SQL(t *testing.T) {
+	stub := newInflux2Stub()
+	defer stub.Close()
+	stub.response = `[{"time":"2024-01-01T00:00:00","meteringpoint":"mp1"},{"time":"2024-01-01T01:00:00","meteringpoint":"mp1"}]`
+	out := testInfluxDB2Output(t, stub.URL, InfluxQuerySQL, true)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := out.WriteData(testMeasurements("mp1", start, 3)); err != nil {
+		t.Fatal(err)
+	}
+	req := stub.requests[0]
+	if req.Path != "/api/v3/query_sql" || req.Auth != "Bearer secret" {
+		t.Errorf("unexpected query request: %s, %q", req.Path, req.Auth)
+	}
+	var body map[string]string
+	if err := json.Unmarshal([]byte(req.Body), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["db"] != "energy" || body["format"] != "json" || !strings.Contains(body["q"], `FROM "gcaruna"`) {
+		t.Errorf("unexpected query body: %v", body)
+	}
+	writes := stub.writes()
+	if len(writes) != 1 || strings.Count(writes[0], "\n") != 1 || !strings.HasSuffix(writes[0], " 1704074400\n") {
+		t.Errorf("expected only the third hour to be written, got %q", writes)
+	}
+}
+
+func TestInfluxDB2SQLNotFound(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		status   int
+		response string
+		ok       bool
+	}{
+		{http.StatusNotFound, `{"error":"database not found: energy"}`, true},
+		{http.StatusBadRequest, `{"error":"error while planning query: table 'public.gcaruna' not found"}`, true},
+		{http.StatusNotFound, "404 page not found", false},
+		{http.StatusInternalServerError, `{"error":"file not found"}`, false},
+	}
+	for _, c := range cases {
+		stub := newInflux2Stub()
+		stub.status = c.status
+		stub.response = c.response
+		out := testInfluxDB2Output(t, stub.URL, InfluxQuerySQL, true)
+		err := out.WriteData(testMeasurements("mp1", start, 3))
+		stub.Close()
+		if c.ok && (err != nil || len(stub.writes()) != 1) {
+			t.Errorf("%s: expected all points written, got %v", c.response, err)
+		}
+		if !c.ok && (err == nil || len(stub.writes()) != 0) {
+			t.Errorf("%s: expected an error and no writes, got %v", c.response, err)
+		}
+	}
+}
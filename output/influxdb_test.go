@@ -0,0 +1,266 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+// influxStub serves /query with a canned response and records /write requests
+type influxStub struct {
+	*httptest.Server
+	response string
+	queries  []string
+	writes   []string
+}
+
+func newInfluxStub() *influxStub {
+	stub := &influxStub{response: `{"results":[{}]}`}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		stub.queries = append(stub.queries, r.FormValue("q"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(stub.response))
+	})
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("precision") != "s" {
+			http.Error(w, "bad precision", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		stub.writes = append(stub.writes, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	stub.Server = httptest.NewServer(mux)
+	return stub
+}
+
+// seriesResponse is a /query response with one series of stored values,
+// an empty status is returned as null like for points written without one
+func seriesResponse(t *testing.T, tag string, value float64, status string, times ...time.Time) string {
+	var st interface{}
+	if status != "" {
+		st = status
+	}
+	values := make([][]interface{}, 0, len(times))
+	for _, ts := range times {
+		values = append(values, []interface{}{ts.UTC().Format(time.RFC3339), value, st})
+	}
+	res := map[string]interface{}{
+		"results": []interface{}{map[string]interface{}{
+			"series": []interface{}{map[string]interface{}{
+				"name":    SeriesName,
+				"tags":    map[string]string{TagName: tag},
+				"columns": []string{"time", FieldName, FieldStatus},
+				"values":  values,
+			}},
+		}},
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func testInfluxDBOutput(t *testing.T, url string, schema *InfluxSchema) *InfluxDBOutput {
+	out, err := NewInfluxDBOutput(&InfluxDBConfig{
+		URL:         url,
+		Database:    "energy",
+		Incremental: true,
+		Schema:      schema,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func testMeasurements(id string, start time.Time, n int) []caruna.HourlyEnergyMeasurement {
+	var hms []caruna.HourlyEnergyMeasurement
+	for i := 0; i < n; i++ {
+		hms = append(hms, caruna.HourlyEnergyMeasurement{
+			MeteringPointId:       id,
+			MeteringPointLocation: []string{"Katu 1", "00100", "Helsinki"},
+			Timestamp:             start.Add(time.Duration(i) * time.Hour),
+			Value:                 1.5,
+			Status:                "OK",
+		})
+	}
+	return hms
+}
+
+func TestInfluxDBEmptyResult(t *testing.T) {
+	stub := newInfluxStub()
+	defer stub.Close()
+	out := testInfluxDBOutput(t, stub.URL, nil)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := out.WriteData(testMeasurements("mp1", start, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.queries) != 1 || !strings.Contains(stub.queries[0], `GROUP BY "meteringpoint"`) {
+		t.Fatalf("unexpected queries: %q", stub.queries)
+	}
+	if len(stub.writes) != 1 {
+		t.Fatalf("expected 1 write, got %d", len(stub.writes))
+	}
+	if lines := strings.Split(strings.TrimSpace(stub.writes[0]), "\n"); len(lines) != 3 {
+		t.Errorf("expected 3 points, got %q", lines)
+	}
+}
+
+func TestInfluxDBDatabaseNotFound(t *testing.T) {
+	stub := newInfluxStub()
+	defer stub.Close()
+	stub.response = `{"results":[{"error":"database not found: energy"}]}`
+	out := testInfluxDBOutput(t, stub.URL, nil)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := out.WriteData(testMeasurements("mp1", start, 3))
+	if err == nil || !strings.Contains(err.Error(), "database not found") {
+		t.Fatalf("expected database not found error, got %v", err)
+	}
+	if len(stub.writes) != 0 {
+		t.Errorf("expected no writes, got %q", stub.writes)
+	}
+}
+
+func TestInfluxDBQuotedTagValue(t *testing.T) {
+	stub := newInfluxStub()
+	defer stub.Close()
+	id := `mp "1" \ 2`
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stub.response = seriesResponse(t, id, 1.5, "OK", start, start.Add(time.Hour))
+	out := testInfluxDBOutput(t, stub.URL, &InfluxSchema{Measurement: SeriesName, PrimaryTag: PrimaryTagId})
+
+	if err := out.WriteData(testMeasurements(id, start, 3)); err != nil {
+		t.Fatal(err)
+	}
+	// The first two hours are matched by the tag value and skipped
+	if len(stub.writes) != 1 {
+		t.Fatalf("expected 1 write, got %d", len(stub.writes))
+	}
+	lines := strings.Split(strings.TrimSpace(stub.writes[0]), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 point, got %q", lines)
+	}
+	if ts := start.Add(2 * time.Hour).Unix(); !strings.HasSuffix(lines[0], " "+strconv.FormatInt(ts, 10)) {
+		t.Errorf("expected timestamp %d, got %q", ts, lines[0])
+	}
+}
+
+func TestInfluxDBQueryPerMeteringPoint(t *testing.T) {
+	stub := newInfluxStub()
+	defer stub.Close()
+	out := testInfluxDBOutput(t, stub.URL, &InfluxSchema{Measurement: SeriesName, PrimaryTag: PrimaryTagId})
+
+	// gcaruna writes each metering point separately
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, id := range []string{"mp1", `mp'2`} {
+		if err := out.WriteMeasurements(testMeasurements(id, start, 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		`SELECT "value", "status" FROM "gcaruna" WHERE ("meteringpoint" = 'mp1') AND time >= '2024-01-01T00:00:00Z' AND time <= '2024-01-01T02:00:00Z' GROUP BY "meteringpoint"`,
+		`SELECT "value", "status" FROM "gcaruna" WHERE ("meteringpoint" = 'mp\'2') AND time >= '2024-01-01T00:00:00Z' AND time <= '2024-01-01T02:00:00Z' GROUP BY "meteringpoint"`,
+	}
+	if strings.Join(stub.queries, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected queries %q, got %q", want, stub.queries)
+	}
+}
+
+func TestInfluxDBBackfill(t *testing.T) {
+	stub := newInfluxStub()
+	defer stub.Close()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stub.response = seriesResponse(t, "mp1", 1.5, "OK", start, start.Add(time.Hour), start.Add(3*time.Hour))
+	out := testInfluxDBOutput(t, stub.URL, &InfluxSchema{Measurement: SeriesName, PrimaryTag: PrimaryTagId})
+	var messages bytes.Buffer
+	out.messages = &messages
+
+	if err := out.WriteData(testMeasurements("mp1", start, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.writes) != 1 {
+		t.Fatalf("expected 1 write, got %d", len(stub.writes))
+	}
+	want := "gcaruna,meteringpoint=mp1 status=\"OK\",value=1.5 " + strconv.FormatInt(start.Add(2*time.Hour).Unix(), 10) + "\n"
+	if stub.writes[0] != want {
+		t.Errorf("expected only hour 2 to be written, got %q", stub.writes[0])
+	}
+	if want := "Meteringpoint mp1: backfilled 1 missing hours\n"; messages.String() != want {
+		t.Errorf("expected message %q, got %q", want, messages.String())
+	}
+}
+
+func TestInfluxDBQueryTransportFailure(t *testing.T) {
+	stub := newInfluxStub()
+	url := stub.URL
+	stub.Close()
+	out := testInfluxDBOutput(t, url, nil)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := out.WriteData(testMeasurements("mp1", start, 3)); err == nil {
+		t.Fatal("expected an error from an unreachable server")
+	}
+}
+
+func TestInfluxDBReconcileUnknownStatus(t *testing.T) {
+	stub := newInfluxStub()
+	defer stub.Close()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var messages bytes.Buffer
+
+	// Stored without status and with the same value: not a revision
+	stub.response = seriesResponse(t, "mp1", 1.5, "", start, start.Add(time.Hour))
+	out := testInfluxDBOutput(t, stub.URL, &InfluxSchema{Measurement: SeriesName, PrimaryTag: PrimaryTagId})
+	out.Config.Reconcile = true
+	out.Config.ReconcileWindow = time.Since(start) + time.Hour
+	out.messages = &messages
+	if err := out.WriteData(testMeasurements("mp1", start, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.writes) != 0 || messages.Len() != 0 {
+		t.Fatalf("expected no revisions, got writes %q, messages %q", stub.writes, messages.String())
+	}
+
+	// Stored without status and with a different value
+	stub.response = seriesResponse(t, "mp1", 1.0, "", start, start.Add(time.Hour))
+	if err := out.WriteData(testMeasurements("mp1", start, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.writes) != 1 {
+		t.Fatalf("expected 1 write, got %d", len(stub.writes))
+	}
+	if want := "Meteringpoint mp1: rewrote 2 revised values\n"; messages.String() != want {
+		t.Errorf("expected message %q, got %q", want, messages.String())
+	}
+}
+
+func TestStoredValueChanged(t *testing.T) {
+	e := caruna.HourlyEnergyMeasurement{Value: 1.5, Status: "OK"}
+	cases := []struct {
+		stored  storedValue
+		changed bool
+	}{
+		{storedValue{1.5, "OK"}, false},
+		{storedValue{1.5, ""}, false},
+		{storedValue{1.5, "ESTIMATED"}, true},
+		{storedValue{1.0, ""}, true},
+	}
+	for _, c := range cases {
+		if got := c.stored.changed(e); got != c.changed {
+			t.Errorf("%+v: expected changed=%t, got %t", c.stored, c.changed, got)
+		}
+	}
+}
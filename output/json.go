@@ -1,14 +1,157 @@
 package output
 
-import(
+import (
 	"encoding/json"
-	"fmt"
-	
+	"io"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+	"github.com/aakso/gcaruna/reconcile"
+)
+
+const (
+	// Bumped on incompatible changes to the JSON document
+	JsonSchemaVersion = 1
+	EnergyUnit        = "kWh"
 )
 
-func PrintJsonOutput(output interface{}) {
-	bs, err := json.MarshalIndent(output, "", "    ")
-	if err == nil {
-		fmt.Println(string(bs))
+func init() {
+	RegisterWriter("json", func(opts *Options) (Output, error) {
+		return NewJsonOutput(opts.Writer, opts.Query), nil
+	})
+	RegisterWriter("ndjson", func(opts *Options) (Output, error) {
+		return NewNdjsonOutput(opts.Writer), nil
+	})
+}
+
+type JsonRange struct {
+	Start time.Time
+	Stop  time.Time
+}
+
+// JsonEnvelope is the document written by the json output
+type JsonEnvelope struct {
+	SchemaVersion  int
+	Generated      time.Time
+	Range          *JsonRange `json:",omitempty"`
+	Unit           string
+	Customer       string
+	MeteringPoints []caruna.MeteringPoint
+	Measurements   []caruna.HourlyEnergyMeasurement
+	Differences    []reconcile.HourDifference `json:",omitempty"`
+}
+
+// JsonOutput collects everything and writes a single indented document on Close
+type JsonOutput struct {
+	w            io.Writer
+	query        *Query
+	points       []caruna.MeteringPoint
+	measurements []caruna.HourlyEnergyMeasurement
+	diffs        []reconcile.HourDifference
+	written      bool
+}
+
+func (self *JsonOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	self.written = true
+	self.points = append(self.points, mps...)
+	return nil
+}
+
+func (self *JsonOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	if self.measurements == nil {
+		self.measurements = make([]caruna.HourlyEnergyMeasurement, 0, len(hms))
+	}
+	self.written = true
+	self.measurements = append(self.measurements, hms...)
+	return nil
+}
+
+func (self *JsonOutput) WriteReconcileReport(diffs []reconcile.HourDifference) error {
+	if self.diffs == nil {
+		self.diffs = make([]reconcile.HourDifference, 0, len(diffs))
+	}
+	self.written = true
+	self.diffs = append(self.diffs, diffs...)
+	return nil
+}
+
+func (self *JsonOutput) Close() error {
+	if !self.written {
+		return nil
+	}
+
+	doc := &JsonEnvelope{
+		SchemaVersion:  JsonSchemaVersion,
+		Generated:      time.Now().UTC(),
+		Unit:           EnergyUnit,
+		MeteringPoints: self.points,
+		Measurements:   self.measurements,
+		Differences:    self.diffs,
+	}
+	if self.query != nil {
+		doc.Customer = self.query.Customer
+		if !self.query.Start.IsZero() {
+			doc.Range = &JsonRange{Start: self.query.Start, Stop: self.query.Stop}
+		}
+		if doc.MeteringPoints == nil {
+			doc.MeteringPoints = self.query.MeteringPoints
+		}
 	}
-}
\ No newline at end of file
+	if doc.MeteringPoints == nil {
+		doc.MeteringPoints = make([]caruna.MeteringPoint, 0)
+	}
+	if doc.Measurements == nil {
+		doc.Measurements = make([]caruna.HourlyEnergyMeasurement, 0)
+	}
+
+	bs, err := json.MarshalIndent(doc, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = self.w.Write(append(bs, '\n'))
+	return err
+}
+
+func NewJsonOutput(w io.Writer, query *Query) *JsonOutput {
+	return &JsonOutput{w: w, query: query}
+}
+
+// NdjsonOutput streams one JSON object per line as data arrives
+type NdjsonOutput struct {
+	enc *json.Encoder
+}
+
+func (self *NdjsonOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	for _, e := range mps {
+		if err := self.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *NdjsonOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	for _, e := range hms {
+		if err := self.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *NdjsonOutput) WriteReconcileReport(diffs []reconcile.HourDifference) error {
+	for _, e := range diffs {
+		if err := self.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *NdjsonOutput) Close() error {
+	return nil
+}
+
+func NewNdjsonOutput(w io.Writer) *NdjsonOutput {
+	return &NdjsonOutput{enc: json.NewEncoder(w)}
+}
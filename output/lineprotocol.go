@@ -0,0 +1,119 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+func init() {
+	RegisterWriter("lineprotocol", func(opts *Options) (Output, error) {
+		schema := DefaultInfluxSchema()
+		if opts.InfluxDB != nil && opts.InfluxDB.Schema != nil {
+			schema = opts.InfluxDB.Schema
+		}
+		if err := schema.Validate(); err != nil {
+			return nil, err
+		}
+		return &LineProtocolOutput{w: bufio.NewWriter(opts.Writer), schema: schema, meta: opts.Query}, nil
+	})
+}
+
+// LineProtocolOutput writes InfluxDB line protocol with the same schema as InfluxDBOutput.
+// Timestamps have second precision, load the result with "influx write --precision s"
+// or post it to a write endpoint with precision=s.
+type LineProtocolOutput struct {
+	w      *bufio.Writer
+	schema *InfluxSchema
+	meta   *Query
+}
+
+func (self *LineProtocolOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	return &ErrNotSupported{Output: "lineprotocol", Data: "metering points"}
+}
+
+func (self *LineProtocolOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	if self.meta != nil {
+		self.schema.SetMeteringPoints(self.meta.MeteringPoints)
+	}
+	for _, e := range hms {
+		line, err := lineProtocol(self.schema.Measurement, self.schema.Tags(e), self.schema.Fields(e), e.Timestamp)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(self.w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return self.w.Flush()
+}
+
+func (self *LineProtocolOutput) Close() error {
+	return self.w.Flush()
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// lineProtocol formats one point in InfluxDB line protocol with second precision
+func lineProtocol(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) (string, error) {
+	if len(fields) == 0 {
+		return "", fmt.Errorf("point has no fields")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(measurementEscaper.Replace(measurement))
+
+	// InfluxDB prefers tags sorted by key
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if tags[k] == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, ",%s=%s", tagEscaper.Replace(k), tagEscaper.Replace(tags[k]))
+	}
+
+	keys = keys[:0]
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(tagEscaper.Replace(k))
+		buf.WriteByte('=')
+		switch v := fields[k].(type) {
+		case float64:
+			buf.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+		case int:
+			fmt.Fprintf(&buf, "%di", v)
+		case int64:
+			fmt.Fprintf(&buf, "%di", v)
+		case bool:
+			buf.WriteString(strconv.FormatBool(v))
+		case string:
+			buf.WriteString(`"` + stringEscaper.Replace(v) + `"`)
+		default:
+			return "", fmt.Errorf("unsupported field type %T for %s", v, k)
+		}
+	}
+	fmt.Fprintf(&buf, " %d", ts.Unix())
+	return buf.String(), nil
+}
@@ -0,0 +1,233 @@
+package output
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aakso/gcaruna/client"
+	"github.com/aakso/gcaruna/reconcile"
+)
+
+// Spec is one entry of an output list: name[:target]. Target is a file path for
+// outputs that write to a writer, without it they write to stdout. Other outputs
+// don't take a target.
+type Spec struct {
+	Name   string
+	Target string
+}
+
+func (s Spec) String() string {
+	if s.Target == "" {
+		return s.Name
+	}
+	return s.Name + ":" + s.Target
+}
+
+// ParseSpecs parses a comma separated output list such as "influxdb,json:/tmp/latest.json,text"
+func ParseSpecs(str string) ([]Spec, error) {
+	ret := make([]Spec, 0)
+	names := Names()
+	for _, e := range strings.Split(str, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		parts := strings.SplitN(e, ":", 2)
+		spec := Spec{Name: parts[0]}
+		if len(parts) == 2 {
+			spec.Target = parts[1]
+		}
+		found := false
+		for _, name := range names {
+			if name == spec.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown output: %s", spec.Name)
+		}
+		if spec.Target != "" && !WritesFile(spec.Name) {
+			return nil, fmt.Errorf("%s output does not write to a file: %s", spec.Name, spec)
+		}
+		ret = append(ret, spec)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no outputs given")
+	}
+	return ret, nil
+}
+
+// Open creates the output described by spec. A target file is only created once the
+// output writes something and it is moved into place on Close.
+func Open(spec Spec, opts Options) (Output, error) {
+	if spec.Target == "" {
+		return New(spec.Name, &opts)
+	}
+	if !WritesFile(spec.Name) {
+		return nil, fmt.Errorf("%s output does not write to a file: %s", spec.Name, spec)
+	}
+	file := &atomicFile{path: spec.Target}
+	opts.Writer = file
+	out, err := New(spec.Name, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &fileOutput{Output: out, name: spec.Name, file: file}, nil
+}
+
+// MultiError carries the errors of several outputs
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// MultiOutput fans data out to several outputs. A failing output doesn't stop the others,
+// errors are collected and returned as MultiError.
+type MultiOutput struct {
+	outputs []Output
+	names   []string
+}
+
+func NewMultiOutput() *MultiOutput {
+	return &MultiOutput{}
+}
+
+func (self *MultiOutput) Add(name string, out Output) {
+	self.names = append(self.names, name)
+	self.outputs = append(self.outputs, out)
+}
+
+func (self *MultiOutput) each(fn func(name string, out Output) error) error {
+	var errs MultiError
+	for i, out := range self.outputs {
+		if err := fn(self.names[i], out); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", self.names[i], err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (self *MultiOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	return self.each(func(name string, out Output) error {
+		return out.WriteMeteringPoints(mps)
+	})
+}
+
+func (self *MultiOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	return self.each(func(name string, out Output) error {
+		return out.WriteMeasurements(hms)
+	})
+}
+
+func (self *MultiOutput) WriteReconcileReport(diffs []reconcile.HourDifference) error {
+	return self.each(func(name string, out Output) error {
+		rw, ok := out.(ReconcileWriter)
+		if !ok {
+			return &ErrNotSupported{Output: name, Data: "reconcile reports"}
+		}
+		return rw.WriteReconcileReport(diffs)
+	})
+}
+
+func (self *MultiOutput) Close() error {
+	return self.each(func(name string, out Output) error {
+		return out.Close()
+	})
+}
+
+// Abort is used instead of Close when the run failed, target files are left untouched
+func (self *MultiOutput) Abort() error {
+	return self.each(func(name string, out Output) error {
+		if a, ok := out.(Aborter); ok {
+			return a.Abort()
+		}
+		return out.Close()
+	})
+}
+
+// fileOutput closes the target file after the wrapped output
+type fileOutput struct {
+	Output
+	name string
+	file *atomicFile
+}
+
+func (self *fileOutput) WriteReconcileReport(diffs []reconcile.HourDifference) error {
+	rw, ok := self.Output.(ReconcileWriter)
+	if !ok {
+		return &ErrNotSupported{Output: self.name, Data: "reconcile reports"}
+	}
+	return rw.WriteReconcileReport(diffs)
+}
+
+func (self *fileOutput) Close() error {
+	err := self.Output.Close()
+	if closeErr := self.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Abort closes the wrapped output but throws away what it wrote
+func (self *fileOutput) Abort() error {
+	self.Output.Close()
+	return self.file.Abort()
+}
+
+// atomicFile writes to a temporary file next to path and renames it over path on Close,
+// so readers never see a partially written file
+type atomicFile struct {
+	path string
+	tmp  *os.File
+}
+
+func (self *atomicFile) Write(p []byte) (int, error) {
+	if self.tmp == nil {
+		tmp, err := ioutil.TempFile(filepath.Dir(self.path), "."+filepath.Base(self.path)+".")
+		if err != nil {
+			return 0, err
+		}
+		self.tmp = tmp
+	}
+	return self.tmp.Write(p)
+}
+
+// Abort removes the temporary file, path is left as it was
+func (self *atomicFile) Abort() error {
+	if self.tmp == nil {
+		return nil
+	}
+	tmp := self.tmp
+	self.tmp = nil
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+func (self *atomicFile) Close() error {
+	if self.tmp == nil {
+		return nil
+	}
+	tmp := self.tmp
+	self.tmp = nil
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), self.path)
+}
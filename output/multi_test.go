@@ -0,0 +1,158 @@
+package output
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSpecs(t *testing.T) {
+	specs, err := ParseSpecs(" influxdb, json:/tmp/latest.json,text,, csv:C:/data/out.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Spec{{"influxdb", ""}, {"json", "/tmp/latest.json"}, {"text", ""}, {"csv", "C:/data/out.csv"}}
+	if len(specs) != len(want) {
+		t.Fatalf("got %v, want %v", specs, want)
+	}
+	for i := range want {
+		if specs[i] != want[i] {
+			t.Errorf("spec %d: got %q, want %q", i, specs[i], want[i])
+		}
+	}
+
+	for _, str := range []string{"", " , ", "nosuch", "json,nosuch:/tmp/x", "influxdb:/x", "remotewrite:out.bin"} {
+		if specs, err := ParseSpecs(str); err == nil {
+			t.Errorf("%q: expected an error, got %v", str, specs)
+		}
+	}
+}
+
+func TestMultiOutputIsolation(t *testing.T) {
+	first := &flakyOutput{}
+	failing := &flakyOutput{down: true, err: errors.New("connection refused")}
+	last := &flakyOutput{}
+	multi := NewMultiOutput()
+	multi.Add("first", first)
+	multi.Add("failing", failing)
+	multi.Add("last", last)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := multi.WriteMeasurements(testMeasurements("mp1", start, 2))
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != 1 || errs[0].Error() != "failing: connection refused" {
+		t.Fatalf("expected one error from the failing output, got %v", err)
+	}
+	if len(first.written) != 2 || len(last.written) != 2 {
+		t.Errorf("expected the other outputs to get 2 points, got %d and %d", len(first.written), len(last.written))
+	}
+
+	// Outputs without reconcile support are reported by name
+	err = multi.WriteReconcileReport(nil)
+	if errs, ok := err.(MultiError); !ok || len(errs) != 3 {
+		t.Fatalf("expected 3 unsupported errors, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "first: first output does not support reconcile reports") {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func testTarget(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "latest.json")
+	if err := ioutil.WriteFile(path, []byte("previous\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, path
+}
+
+func openTarget(t *testing.T, path string) *MultiOutput {
+	out, err := Open(Spec{Name: "ndjson", Target: path}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	multi := NewMultiOutput()
+	multi.Add("ndjson", out)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := multi.WriteMeasurements(testMeasurements("mp1", start, 2)); err != nil {
+		t.Fatal(err)
+	}
+	return multi
+}
+
+func dirEntries(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret []string
+	for _, info := range infos {
+		ret = append(ret, info.Name())
+	}
+	return ret
+}
+
+func TestMultiOutputAbort(t *testing.T) {
+	dir, path := testTarget(t)
+	defer os.RemoveAll(dir)
+
+	if err := openTarget(t, path).Abort(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "previous\n" {
+		t.Errorf("expected the target to be untouched, got %q", data)
+	}
+	if names := dirEntries(t, dir); len(names) != 1 {
+		t.Errorf("expected the temporary file to be removed, got %v", names)
+	}
+}
+
+func TestMultiOutputClose(t *testing.T) {
+	dir, path := testTarget(t)
+	defer os.RemoveAll(dir)
+
+	if err := openTarget(t, path).Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"mp1"`) {
+		t.Errorf("expected 2 measurements in the target, got %q", data)
+	}
+	if names := dirEntries(t, dir); len(names) != 1 {
+		t.Errorf("expected only the target file, got %v", names)
+	}
+}
+
+func TestAtomicFileUnwritten(t *testing.T) {
+	dir, path := testTarget(t)
+	defer os.RemoveAll(dir)
+
+	// Nothing written, the target is kept as is
+	file := &atomicFile{path: path}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "previous\n" {
+		t.Errorf("expected the target to be untouched, got %q, %v", data, err)
+	}
+}
+
+func TestOpenRejectsTarget(t *testing.T) {
+	if _, err := Open(Spec{Name: "influxdb", Target: "/x"}, Options{}); err == nil {
+		t.Fatal("expected an error for a target on influxdb")
+	}
+}
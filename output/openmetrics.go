@@ -0,0 +1,88 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+func init() {
+	RegisterWriter("openmetrics", func(opts *Options) (Output, error) {
+		return NewOpenMetricsOutput(opts.Writer, opts.Query), nil
+	})
+}
+
+// OpenMetricsOutput writes an OpenMetrics text file with explicit timestamps for
+// backfilling with "promtool tsdb create-blocks-from openmetrics". The consumption
+// gauge matches the serve subcommand. The file is written on Close because samples
+// of a metric family have to be grouped together.
+type OpenMetricsOutput struct {
+	w      io.Writer
+	meta   *Query
+	series []*promSeries
+	index  map[string]*promSeries
+}
+
+func (self *OpenMetricsOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	return &ErrNotSupported{Output: "openmetrics", Data: "metering points"}
+}
+
+func (self *OpenMetricsOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	var mps []caruna.MeteringPoint
+	if self.meta != nil {
+		mps = self.meta.MeteringPoints
+	}
+	for _, e := range hms {
+		s, ok := self.index[e.MeteringPointId]
+		if !ok {
+			s = &promSeries{labels: promLabelsFor(e, mps)}
+			self.index[e.MeteringPointId] = s
+			self.series = append(self.series, s)
+		}
+		s.samples = append(s.samples, e)
+	}
+	return nil
+}
+
+func (self *OpenMetricsOutput) Close() error {
+	w := bufio.NewWriter(self.w)
+	for _, s := range self.series {
+		sort.Sort(byTimestamp(s.samples))
+	}
+
+	if len(self.series) > 0 {
+		fmt.Fprintf(w, "# HELP %s Consumption of the hour\n", MetricConsumption)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", MetricConsumption)
+		for _, s := range self.series {
+			name := PromSeries(MetricConsumption, s.labels)
+			for _, e := range s.samples {
+				fmt.Fprintf(w, "%s %s %d\n", name, PromValue(e.Value), e.Timestamp.Unix())
+			}
+		}
+
+		// Counters start from the first hour in the file
+		fmt.Fprintf(w, "# HELP %s Energy consumed since the first exported hour\n", MetricBackfillEnergy)
+		fmt.Fprintf(w, "# TYPE %s counter\n", MetricBackfillEnergy)
+		for _, s := range self.series {
+			name := PromSeries(MetricBackfillEnergy+"_total", s.labels)
+			total := 0.0
+			for _, e := range s.samples {
+				total += e.Value
+				fmt.Fprintf(w, "%s %s %d\n", name, PromValue(total), e.Timestamp.Unix())
+			}
+		}
+	}
+	fmt.Fprintln(w, "# EOF")
+	return w.Flush()
+}
+
+func NewOpenMetricsOutput(w io.Writer, meta *Query) *OpenMetricsOutput {
+	return &OpenMetricsOutput{
+		w:     w,
+		meta:  meta,
+		index: make(map[string]*promSeries),
+	}
+}
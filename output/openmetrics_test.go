@@ -0,0 +1,34 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestOpenMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	out := NewOpenMetricsOutput(&buf, nil)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hms := testMeasurements("mp1", start, 2)
+	hms[0], hms[1] = hms[1], hms[0]
+	if err := out.WriteMeasurements(hms); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	labels := `{metering_point="mp1",address="Katu 1, 00100, Helsinki"}`
+	want := "# HELP gcaruna_consumption_kwh Consumption of the hour\n" +
+		"# TYPE gcaruna_consumption_kwh gauge\n" +
+		"gcaruna_consumption_kwh" + labels + " 1.5 1704067200\n" +
+		"gcaruna_consumption_kwh" + labels + " 1.5 1704070800\n" +
+		"# HELP gcaruna_backfill_energy_kwh Energy consumed since the first exported hour\n" +
+		"# TYPE gcaruna_backfill_energy_kwh counter\n" +
+		"gcaruna_backfill_energy_kwh_total" + labels + " 1.5 1704067200\n" +
+		"gcaruna_backfill_energy_kwh_total" + labels + " 3 1704070800\n" +
+		"# EOF\n"
+	if buf.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+}
@@ -0,0 +1,139 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+	"github.com/aakso/gcaruna/reconcile"
+)
+
+// Output writes fetched data to some destination. WriteMeasurements may be called
+// more than once per run, outputs that need all data at once should buffer until Close.
+type Output interface {
+	WriteMeteringPoints(mps []caruna.MeteringPoint) error
+	WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error
+	Close() error
+}
+
+// Aborter is implemented by outputs that can discard what they have written so far.
+// Outputs without it are closed instead.
+type Aborter interface {
+	Abort() error
+}
+
+// ReconcileWriter is implemented by outputs that can present a Datahub reconcile report
+type ReconcileWriter interface {
+	WriteReconcileReport(diffs []reconcile.HourDifference) error
+}
+
+// Options are passed to output factories. Outputs pick what they need.
+type Options struct {
+	Writer      io.Writer
+	Location    *time.Location
+	Logger      *log.Logger
+	InfluxDB    *InfluxDBConfig
+	InfluxDB2   *InfluxDB2Config
+	InfluxDB08  *InfluxDB08Config
+	Spool       *SpoolConfig
+	RemoteWrite *RemoteWriteConfig
+	Text        *TextConfig
+	CSV         *CSVConfig
+	Chart       *ChartConfig
+	Template    *TemplateConfig
+	Query       *Query
+	// Notices shown without -debug, such as backfilled and revised values
+	// and spooled points. Defaults to stderr.
+	Messages io.Writer
+}
+
+// Query describes the run. Customer and MeteringPoints are filled in once known,
+// before any data is written.
+type Query struct {
+	Start          time.Time
+	Stop           time.Time
+	Customer       string
+	MeteringPoints []caruna.MeteringPoint
+}
+
+type Factory func(opts *Options) (Output, error)
+
+type registration struct {
+	factory Factory
+	writer  bool
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]registration)
+)
+
+// Register makes an output available by name. It is meant to be called from init functions.
+func Register(name string, factory Factory) {
+	register(name, registration{factory: factory})
+}
+
+// RegisterWriter registers an output that writes to Options.Writer, these
+// can be given a target file
+func RegisterWriter(name string, factory Factory) {
+	register(name, registration{factory: factory, writer: true})
+}
+
+func register(name string, reg registration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if reg.factory == nil {
+		panic("output: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("output: Register called twice for " + name)
+	}
+	registry[name] = reg
+}
+
+// WritesFile tells if the named output writes to Options.Writer
+func WritesFile(name string) bool {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return registry[name].writer
+}
+
+// Names returns the sorted names of registered outputs
+func Names() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	ret := make([]string, 0, len(registry))
+	for name := range registry {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// New creates a registered output
+func New(name string, opts *Options) (Output, error) {
+	registryMu.Lock()
+	reg, ok := registry[name]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown output: %s", name)
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	return reg.factory(opts)
+}
+
+// ErrNotSupported is returned when an output can't handle the given kind of data
+type ErrNotSupported struct {
+	Output string
+	Data   string
+}
+
+func (e *ErrNotSupported) Error() string {
+	return fmt.Sprintf("%s output does not support %s", e.Output, e.Data)
+}
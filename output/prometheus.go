@@ -0,0 +1,72 @@
+package output
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+// Prometheus metric names. The exporter and the Prometheus outputs share the
+// consumption gauge so that backfilled and live data join up. Counters are exposed
+// with the _total suffix and count from different starting points, so they have
+// names of their own.
+const (
+	MetricConsumption    = "gcaruna_consumption_kwh"
+	MetricEnergy         = "gcaruna_energy_kwh"          // Exporter, since it started
+	MetricBackfillEnergy = "gcaruna_backfill_energy_kwh" // OpenMetrics, since the first hour of the file
+)
+
+type PromLabel struct {
+	Name  string
+	Value string
+}
+
+// PromLabels identify a metering point. The type is left out when it is not known.
+func PromLabels(id string, location []string, typ string) []PromLabel {
+	labels := []PromLabel{
+		{"metering_point", id},
+		{"address", strings.Join(location, ", ")},
+	}
+	if typ != "" {
+		labels = append(labels, PromLabel{"type", typ})
+	}
+	return labels
+}
+
+// promLabelsFor returns the labels of a measurement, the type is looked up from mps
+func promLabelsFor(e caruna.HourlyEnergyMeasurement, mps []caruna.MeteringPoint) []PromLabel {
+	typ := ""
+	for _, mp := range mps {
+		if mp.MeteringPointNumber == e.MeteringPointId {
+			typ = mp.MeteringPointType
+			break
+		}
+	}
+	return PromLabels(e.MeteringPointId, e.MeteringPointLocation, typ)
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// PromSeries formats a metric name with its labels, e.g. name{a="b"}
+func PromSeries(name string, labels []PromLabel) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(l.Name + `="` + promLabelEscaper.Replace(l.Value) + `"`)
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func PromValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
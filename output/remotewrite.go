@@ -0,0 +1,222 @@
+package output
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+	"github.com/golang/snappy"
+)
+
+func init() {
+	Register("remotewrite", func(opts *Options) (Output, error) {
+		if opts.RemoteWrite == nil {
+			return nil, fmt.Errorf("remotewrite output is not configured")
+		}
+		out, err := NewRemoteWriteOutput(opts.RemoteWrite)
+		if err != nil {
+			return nil, err
+		}
+		out.meta = opts.Query
+		if opts.Logger != nil {
+			out.SetLogger(opts.Logger)
+		}
+		return spool(opts, "remotewrite", out, out.logger), nil
+	})
+}
+
+type RemoteWriteConfig struct {
+	URL         string
+	Username    string
+	Password    string
+	BearerToken string
+	// Sent as X-Scope-OrgID for multi-tenant Mimir and Cortex
+	Tenant    string
+	BatchSize int
+}
+
+// RemoteWriteOutput pushes measurements with their original timestamps using the
+// Prometheus remote-write protocol. The receiver has to accept out-of-order samples,
+// Mimir and VictoriaMetrics can be configured to do so.
+type RemoteWriteOutput struct {
+	logger *log.Logger
+	Client *http.Client
+	Config *RemoteWriteConfig
+	meta   *Query
+}
+
+type promSeries struct {
+	labels  []PromLabel
+	samples []caruna.HourlyEnergyMeasurement
+}
+
+func (self *RemoteWriteOutput) SetLogger(logger *log.Logger) {
+	self.logger = logger
+	self.logger.SetPrefix("[RemoteWriteOutput] ")
+}
+
+func (self *RemoteWriteOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	return &ErrNotSupported{Output: "remotewrite", Data: "metering points"}
+}
+
+func (self *RemoteWriteOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	var mps []caruna.MeteringPoint
+	if self.meta != nil {
+		mps = self.meta.MeteringPoints
+	}
+
+	// One series per metering point, split into requests of at most BatchSize samples
+	var batch []*promSeries
+	index := make(map[string]*promSeries)
+	count := 0
+	for _, e := range hms {
+		s, ok := index[e.MeteringPointId]
+		if !ok {
+			labels := append([]PromLabel{{"__name__", MetricConsumption}}, promLabelsFor(e, mps)...)
+			sort.Sort(byLabelName(labels))
+			s = &promSeries{labels: labels}
+			index[e.MeteringPointId] = s
+			batch = append(batch, s)
+		}
+		s.samples = append(s.samples, e)
+		count++
+		if self.Config.BatchSize > 0 && count >= self.Config.BatchSize {
+			if err := self.send(batch); err != nil {
+				return err
+			}
+			batch, index, count = nil, make(map[string]*promSeries), 0
+		}
+	}
+	if count > 0 {
+		return self.send(batch)
+	}
+	return nil
+}
+
+func (self *RemoteWriteOutput) Close() error {
+	return nil
+}
+
+func (self *RemoteWriteOutput) send(batch []*promSeries) error {
+	var req protoBuf
+	count := 0
+	for _, s := range batch {
+		sort.Sort(byTimestamp(s.samples))
+		var ts protoBuf
+		for _, l := range s.labels {
+			var label protoBuf
+			label.stringField(1, l.Name)
+			label.stringField(2, l.Value)
+			ts.bytesField(1, label.Bytes())
+		}
+		for _, e := range s.samples {
+			var sample protoBuf
+			sample.doubleField(1, e.Value)
+			sample.int64Field(2, e.Timestamp.UnixNano()/int64(time.Millisecond))
+			ts.bytesField(2, sample.Bytes())
+			count++
+		}
+		req.bytesField(1, ts.Bytes())
+	}
+
+	httpReq, err := http.NewRequest("POST", self.Config.URL, bytes.NewReader(snappy.Encode(nil, req.Bytes())))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if self.Config.Tenant != "" {
+		httpReq.Header.Set("X-Scope-OrgID", self.Config.Tenant)
+	}
+	if self.Config.BearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+self.Config.BearerToken)
+	} else if self.Config.Username != "" {
+		httpReq.SetBasicAuth(self.Config.Username, self.Config.Password)
+	}
+	resp, err := self.Client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{code: resp.StatusCode, status: resp.Status, msg: string(bytes.TrimSpace(msg))}
+	}
+	self.logger.Printf("Wrote %d samples in %d series", count, len(batch))
+	return nil
+}
+
+func NewRemoteWriteOutput(config *RemoteWriteConfig) (*RemoteWriteOutput, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("remotewrite output needs an url")
+	}
+	ret := &RemoteWriteOutput{
+		Client: &http.Client{Timeout: 60 * time.Second},
+		Config: config,
+	}
+	ret.SetLogger(log.New(ioutil.Discard, "", log.LstdFlags))
+	return ret, nil
+}
+
+// protoBuf encodes the few protobuf wire types the remote-write messages need:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+type protoBuf struct {
+	bytes.Buffer
+}
+
+func (self *protoBuf) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	self.Write(buf[:n])
+}
+
+func (self *protoBuf) key(field, wireType int) {
+	self.varint(uint64(field<<3 | wireType))
+}
+
+func (self *protoBuf) bytesField(field int, p []byte) {
+	self.key(field, 2)
+	self.varint(uint64(len(p)))
+	self.Write(p)
+}
+
+func (self *protoBuf) stringField(field int, s string) {
+	self.bytesField(field, []byte(s))
+}
+
+func (self *protoBuf) doubleField(field int, v float64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	self.key(field, 1)
+	self.Write(buf[:])
+}
+
+func (self *protoBuf) int64Field(field int, v int64) {
+	self.key(field, 0)
+	self.varint(uint64(v))
+}
+
+type byLabelName []PromLabel
+
+func (s byLabelName) Len() int           { return len(s) }
+func (s byLabelName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLabelName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+type byTimestamp []caruna.HourlyEnergyMeasurement
+
+func (s byTimestamp) Len() int           { return len(s) }
+func (s byTimestamp) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTimestamp) Less(i, j int) bool { return s[i].Timestamp.Before(s[j].Timestamp) }
@@ -0,0 +1,311 @@
+package output
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+	"github.com/golang/snappy"
+)
+
+type remoteSample struct {
+	value     float64
+	timestamp int64
+}
+
+type remoteSeries struct {
+	labels  []PromLabel
+	samples []remoteSample
+}
+
+// protoReader decodes the wire types written by protoBuf
+type protoReader struct {
+	buf []byte
+	err error
+}
+
+func (self *protoReader) varint() uint64 {
+	v, n := binary.Uvarint(self.buf)
+	if n <= 0 {
+		self.err = errors.New("bad varint")
+		self.buf = nil
+		return 0
+	}
+	self.buf = self.buf[n:]
+	return v
+}
+
+// next returns the next field, its wire type, its varint or fixed64 value and its bytes
+func (self *protoReader) next() (field, wireType int, v uint64, p []byte) {
+	key := self.varint()
+	field, wireType = int(key>>3), int(key&7)
+	switch wireType {
+	case 0:
+		v = self.varint()
+	case 1:
+		if len(self.buf) < 8 {
+			self.err = errors.New("short fixed64")
+			self.buf = nil
+			return
+		}
+		v = binary.LittleEndian.Uint64(self.buf)
+		self.buf = self.buf[8:]
+	case 2:
+		n := int(self.varint())
+		if n > len(self.buf) {
+			self.err = errors.New("short bytes")
+			self.buf = nil
+			return
+		}
+		p = self.buf[:n]
+		self.buf = self.buf[n:]
+	default:
+		self.err = fmt.Errorf("unexpected wire type %d", wireType)
+		self.buf = nil
+	}
+	return
+}
+
+// expect reads the next field and fails unless it is one of the given field
+// numbers with its wire type, fields maps field numbers to wire types
+func (self *protoReader) expect(message string, fields map[int]int) (int, uint64, []byte) {
+	field, wireType, v, p := self.next()
+	if self.err != nil {
+		return 0, 0, nil
+	}
+	if want, ok := fields[field]; !ok || want != wireType {
+		self.err = fmt.Errorf("%s: unexpected field %d with wire type %d", message, field, wireType)
+		self.buf = nil
+		return 0, 0, nil
+	}
+	return field, v, p
+}
+
+var (
+	writeRequestFields = map[int]int{1: 2}       // timeseries
+	timeSeriesFields   = map[int]int{1: 2, 2: 2} // labels, samples
+	labelFields        = map[int]int{1: 2, 2: 2} // name, value
+	sampleFields       = map[int]int{1: 1, 2: 0} // value as fixed64, timestamp as varint
+)
+
+func parseWriteRequest(data []byte) ([]remoteSeries, error) {
+	var ret []remoteSeries
+	req := &protoReader{buf: data}
+	for len(req.buf) > 0 {
+		_, _, p := req.expect("WriteRequest", writeRequestFields)
+		var s remoteSeries
+		ts := &protoReader{buf: p}
+		for len(ts.buf) > 0 {
+			field, _, p := ts.expect("TimeSeries", timeSeriesFields)
+			r := &protoReader{buf: p}
+			switch field {
+			case 1:
+				var l PromLabel
+				for len(r.buf) > 0 {
+					f, _, p := r.expect("Label", labelFields)
+					switch f {
+					case 1:
+						l.Name = string(p)
+					case 2:
+						l.Value = string(p)
+					}
+				}
+				s.labels = append(s.labels, l)
+			case 2:
+				var sample remoteSample
+				for len(r.buf) > 0 {
+					f, v, _ := r.expect("Sample", sampleFields)
+					switch f {
+					case 1:
+						sample.value = math.Float64frombits(v)
+					case 2:
+						sample.timestamp = int64(v)
+					}
+				}
+				s.samples = append(s.samples, sample)
+			}
+			if r.err != nil {
+				return nil, r.err
+			}
+		}
+		if ts.err != nil {
+			return nil, ts.err
+		}
+		ret = append(ret, s)
+	}
+	return ret, req.err
+}
+
+// newRemoteWriteStub decodes every request into a WriteRequest
+func newRemoteWriteStub(t *testing.T, requests *[][]remoteSeries) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" ||
+			r.Header.Get("X-Scope-OrgID") != "home" {
+
+			t.Errorf("unexpected headers: %v", r.Header)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series, err := parseWriteRequest(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*requests = append(*requests, series)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var requests [][]remoteSeries
+	server := newRemoteWriteStub(t, &requests)
+	defer server.Close()
+	out, err := NewRemoteWriteOutput(&RemoteWriteConfig{URL: server.URL, Tenant: "home", BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hours of mp1 arrive out of order
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mp1 := testMeasurements("mp1", start, 4)
+	hms := []caruna.HourlyEnergyMeasurement{mp1[1], mp1[0]}
+	hms = append(hms, testMeasurements("mp2", start, 1)...)
+	hms = append(hms, mp1[3], mp1[2])
+	if err := out.WriteMeasurements(hms); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests of at most 3 samples, got %d", len(requests))
+	}
+	want := [][]struct {
+		id    string
+		hours []int
+	}{
+		{{"mp1", []int{0, 1}}, {"mp2", []int{0}}},
+		{{"mp1", []int{2, 3}}},
+	}
+	for i, req := range requests {
+		if len(req) != len(want[i]) {
+			t.Fatalf("request %d: expected %d series, got %d", i, len(want[i]), len(req))
+		}
+		for j, s := range req {
+			if s.labels[0].Name != "__name__" || s.labels[0].Value != MetricConsumption {
+				t.Errorf("request %d: expected __name__ first, got %v", i, s.labels)
+			}
+			if !sort.IsSorted(byLabelName(s.labels)) {
+				t.Errorf("request %d: labels are not sorted: %v", i, s.labels)
+			}
+			id := ""
+			for _, l := range s.labels {
+				if l.Name == "metering_point" {
+					id = l.Value
+				}
+			}
+			if id != want[i][j].id || len(s.samples) != len(want[i][j].hours) {
+				t.Fatalf("request %d: unexpected series %v", i, s)
+			}
+			for k, h := range want[i][j].hours {
+				ms := start.Add(time.Duration(h)*time.Hour).Unix() * 1000
+				if s.samples[k].timestamp != ms || s.samples[k].value != 1.5 {
+					t.Errorf("request %d, %s: expected sample %d at %d, got %v", i, id, k, ms, s.samples[k])
+				}
+			}
+		}
+	}
+}
+
+func TestRemoteWriteError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	out, err := NewRemoteWriteOutput(&RemoteWriteConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err = out.WriteMeasurements(testMeasurements("mp1", start, 1))
+	if err == nil || err.Error() != "Non-ok http status: 400 Bad Request: out of order sample" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// The encoding of one series is checked byte by byte
+func TestRemoteWriteEncoding(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	out, err := NewRemoteWriteOutput(&RemoteWriteConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := &promSeries{
+		labels: []PromLabel{{"__name__", "energy"}, {"a", "b"}},
+		samples: []caruna.HourlyEnergyMeasurement{
+			{Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Value: 1.5},
+		},
+	}
+	if err := out.send([]*promSeries{series}); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := hex.DecodeString(strings.Replace(strings.Join([]string{
+		"0a 2e",                         // WriteRequest.timeseries, 46 bytes
+		"0a 12",                         // TimeSeries.labels, 18 bytes
+		"0a 08 5f 5f 6e 61 6d 65 5f 5f", // Label.name "__name__"
+		"12 06 65 6e 65 72 67 79",       // Label.value "energy"
+		"0a 06 0a 01 61 12 01 62",       // TimeSeries.labels {"a", "b"}
+		"12 10",                         // TimeSeries.samples, 16 bytes
+		"09 00 00 00 00 00 00 f8 3f",    // Sample.value 1.5 as fixed64
+		"10 80 e8 c7 92 cc 31",          // Sample.timestamp 1704067200000 as varint
+	}, " "), " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, want) {
+		t.Errorf("got\n% x\nwant\n% x", body, want)
+	}
+}
+
+func TestParseWriteRequestStrict(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data string
+	}{
+		{"timeseries as varint", "08 01"},
+		{"unknown timeseries field", "0a 02 1a 00"},
+		{"labels as varint", "0a 02 08 01"},
+		{"unknown label field", "0a 04 0a 02 1a 00"},
+		{"value as varint", "0a 04 12 02 08 01"},
+		{"timestamp as fixed64", "0a 0b 12 09 11 00 00 00 00 00 00 00 00"},
+		{"unknown sample field", "0a 04 12 02 18 01"},
+	} {
+		data, err := hex.DecodeString(strings.Replace(c.data, " ", "", -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if series, err := parseWriteRequest(data); err == nil {
+			t.Errorf("%s: expected an error, got %v", c.name, series)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package output
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"time"
+)
+
+// retry calls fn until it succeeds or it has been retried the given number of times.
+// The delay doubles after each failed attempt. Errors that won't go away by waiting
+// are returned immediately.
+func retry(retries int, delay time.Duration, logger *log.Logger, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= retries || !temporary(err) {
+			return err
+		}
+		logger.Printf("Attempt %d failed: %s, retrying in %s", attempt+1, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// statusError is a non-2xx http response
+type statusError struct {
+	code   int
+	status string
+	path   string
+	msg    string
+}
+
+func (self *statusError) Error() string {
+	if self.path == "" {
+		return fmt.Sprintf("Non-ok http status: %s: %s", self.status, self.msg)
+	}
+	return fmt.Sprintf("Non-ok http status: %s %s: %s", self.status, self.path, self.msg)
+}
+
+// wrappedError adds context to an error without hiding it from temporary
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func wrapError(err error, format string, args ...interface{}) error {
+	return &wrappedError{msg: fmt.Sprintf(format, args...), err: err}
+}
+
+func (self *wrappedError) Error() string {
+	return self.msg + ": " + self.err.Error()
+}
+
+// temporary tells if a write may succeed later: the server could not be reached or
+// it failed with a 5xx status. Anything else, such as a rejected request, is permanent.
+func temporary(err error) bool {
+	switch e := err.(type) {
+	case *statusError:
+		return e.code >= 500
+	case *wrappedError:
+		return temporary(e.err)
+	case *url.Error, net.Error:
+		return true
+	}
+	return false
+}
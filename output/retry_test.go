@@ -0,0 +1,90 @@
+package output
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingInflux answers writes with the given statuses in turn, then with 204
+func failingInflux(statuses ...int) (*httptest.Server, *int) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/write" {
+			http.NotFound(w, r)
+			return
+		}
+		attempts++
+		if attempts <= len(statuses) {
+			http.Error(w, `{"error":"failed"}`, statuses[attempts-1])
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return server, &attempts
+}
+
+func testRetryOutput(t *testing.T, url string) *InfluxDBOutput {
+	out, err := NewInfluxDBOutput(&InfluxDBConfig{
+		URL:        url,
+		Database:   "energy",
+		Retries:    3,
+		RetryDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRetryServerError(t *testing.T) {
+	server, attempts := failingInflux(http.StatusServiceUnavailable)
+	defer server.Close()
+	out := testRetryOutput(t, server.URL)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := out.WriteData(testMeasurements("mp1", start, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if *attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", *attempts)
+	}
+}
+
+func TestRetryBadRequest(t *testing.T) {
+	server, attempts := failingInflux(http.StatusBadRequest)
+	defer server.Close()
+	out := testRetryOutput(t, server.URL)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := out.WriteData(testMeasurements("mp1", start, 2))
+	if err == nil || !strings.Contains(err.Error(), "400 Bad Request") {
+		t.Fatalf("expected a 400 error, got %v", err)
+	}
+	if *attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", *attempts)
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	cases := []struct {
+		err       error
+		temporary bool
+	}{
+		{&statusError{code: 500}, true},
+		{&statusError{code: 503}, true},
+		{&statusError{code: 400}, false},
+		{&statusError{code: 401}, false},
+		{&url.Error{Op: "Post", URL: "http://localhost", Err: errors.New("connection refused")}, true},
+		{errors.New("database not found"), false},
+	}
+	for _, c := range cases {
+		if got := temporary(c.err); got != c.temporary {
+			t.Errorf("%#v: expected temporary=%t, got %t", c.err, c.temporary, got)
+		}
+	}
+}
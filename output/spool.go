@@ -0,0 +1,167 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+type SpoolConfig struct {
+	Dir     string
+	MaxSize int64
+}
+
+// spool wraps a database output with a spool if one is configured
+func spool(opts *Options, name string, out Output, logger *log.Logger) Output {
+	if opts.Spool == nil || opts.Spool.Dir == "" {
+		return out
+	}
+	messages := opts.Messages
+	if messages == nil {
+		messages = os.Stderr
+	}
+	return &SpoolOutput{
+		Output:   out,
+		path:     filepath.Join(opts.Spool.Dir, name+".spool"),
+		config:   opts.Spool,
+		logger:   logger,
+		messages: messages,
+	}
+}
+
+// SpoolOutput keeps measurements that the wrapped output failed to write because
+// the database was unreachable or failed with a 5xx status in an append-only file
+// and replays them before the first write of the next run.
+// Replayed points may be written twice if we crash before the spool is removed,
+// which is harmless for time-series databases.
+type SpoolOutput struct {
+	Output
+	path   string
+	config *SpoolConfig
+	logger *log.Logger
+	// Spooling hides the write error so it is reported here instead
+	messages io.Writer
+	replayed bool
+}
+
+func (self *SpoolOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	if !self.replayed {
+		self.replayed = true
+		spooled, err := self.load()
+		if err != nil {
+			return err
+		}
+		if len(spooled) > 0 {
+			self.logger.Printf("Replaying %d spooled points from %s", len(spooled), self.path)
+			hms = append(spooled, hms...)
+		}
+		if err := self.Output.WriteMeasurements(hms); err != nil {
+			// The failed spooled points are still on disk
+			return self.append(hms[len(spooled):], err)
+		}
+		if len(spooled) > 0 {
+			return os.Remove(self.path)
+		}
+		return nil
+	}
+	if err := self.Output.WriteMeasurements(hms); err != nil {
+		return self.append(hms, err)
+	}
+	return nil
+}
+
+func (self *SpoolOutput) Close() error {
+	// Replay even if this run had nothing to write
+	if !self.replayed {
+		if _, err := os.Stat(self.path); err == nil {
+			if err := self.WriteMeasurements(nil); err != nil {
+				self.Output.Close()
+				return err
+			}
+		}
+	}
+	return self.Output.Close()
+}
+
+// load reads the spool. A partially written last line from a crash is skipped.
+func (self *SpoolOutput) load() ([]caruna.HourlyEnergyMeasurement, error) {
+	data, err := ioutil.ReadFile(self.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read spool: %s", err)
+	}
+	ret := make([]caruna.HourlyEnergyMeasurement, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e caruna.HourlyEnergyMeasurement
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			fmt.Fprintf(self.messages, "WARNING: Skipping corrupt entry in spool %s: %s\n", self.path, err)
+			continue
+		}
+		ret = append(ret, e)
+	}
+	return ret, scanner.Err()
+}
+
+// append adds hms to the spool. writeErr is the reason they are spooled and it is
+// returned if they can't be.
+func (self *SpoolOutput) append(hms []caruna.HourlyEnergyMeasurement, writeErr error) error {
+	// Rejected points would fail again on every replay
+	if len(hms) == 0 || !temporary(writeErr) {
+		return writeErr
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range hms {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	// When full, new points are dropped rather than old ones, the next run can
+	// fetch recent hours from Caruna again
+	var size int64
+	if fi, err := os.Stat(self.path); err == nil {
+		size = fi.Size()
+	}
+	if self.config.MaxSize > 0 && size+int64(buf.Len()) > self.config.MaxSize {
+		return fmt.Errorf("%s (spool %s is full, dropped %d points)", writeErr, self.path, len(hms))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(self.path), 0755); err != nil {
+		return fmt.Errorf("%s (Cannot spool: %s)", writeErr, err)
+	}
+	f, err := os.OpenFile(self.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("%s (Cannot spool: %s)", writeErr, err)
+	}
+	// Terminate a partial line left by a crash so that it doesn't swallow ours
+	if size > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, size-1); err == nil && last[0] != '\n' {
+			f.Write([]byte{'\n'})
+		}
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s (Cannot spool: %s)", writeErr, err)
+	}
+	fmt.Fprintf(self.messages, "WARNING: %s, spooled %d points to %s\n", writeErr, len(hms), self.path)
+	return nil
+}
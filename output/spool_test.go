@@ -0,0 +1,204 @@
+package output
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+// flakyOutput records written measurements and fails with err while down is set
+type flakyOutput struct {
+	down    bool
+	err     error
+	written []caruna.HourlyEnergyMeasurement
+}
+
+// unavailable is a temporary failure that is spooled
+var unavailable = &statusError{code: http.StatusServiceUnavailable, status: "503 Service Unavailable", msg: "timeout"}
+
+func (self *flakyOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	return nil
+}
+
+func (self *flakyOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	if self.down {
+		return self.err
+	}
+	self.written = append(self.written, hms...)
+	return nil
+}
+
+func (self *flakyOutput) Close() error {
+	return nil
+}
+
+func testSpool(t *testing.T, dir string, out Output, maxSize int64) (*SpoolOutput, *bytes.Buffer) {
+	var messages bytes.Buffer
+	opts := &Options{
+		Spool:    &SpoolConfig{Dir: dir, MaxSize: maxSize},
+		Messages: &messages,
+	}
+	s, ok := spool(opts, "test", out, log.New(ioutil.Discard, "", 0)).(*SpoolOutput)
+	if !ok {
+		t.Fatal("expected a spool")
+	}
+	return s, &messages
+}
+
+func timestamps(hms []caruna.HourlyEnergyMeasurement) []int64 {
+	var ret []int64
+	for _, e := range hms {
+		ret = append(ret, e.Timestamp.Unix())
+	}
+	return ret
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hms := testMeasurements("mp1", start, 4)
+
+	// First run fails, the points are spooled with a warning
+	out := &flakyOutput{down: true, err: unavailable}
+	s, messages := testSpool(t, dir, out, 0)
+	if err := s.WriteMeasurements(hms[:2]); err != nil {
+		t.Fatalf("expected the failure to be spooled, got %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(messages.String(), "WARNING: Non-ok http status: 503 Service Unavailable: timeout, spooled 2 points to ") {
+		t.Errorf("expected a spool warning, got %q", messages.String())
+	}
+
+	// Next run replays them before its own points and removes the spool
+	out = &flakyOutput{}
+	s, messages = testSpool(t, dir, out, 0)
+	if err := s.WriteMeasurements(hms[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if got := timestamps(out.written); len(got) != 4 || got[0] != start.Unix() || got[3] != hms[3].Timestamp.Unix() {
+		t.Errorf("expected spooled points first, got %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.spool")); !os.IsNotExist(err) {
+		t.Errorf("expected the spool to be removed, got %v", err)
+	}
+	if messages.Len() != 0 {
+		t.Errorf("unexpected messages: %q", messages.String())
+	}
+}
+
+func TestSpoolReplayOnClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s, _ := testSpool(t, dir, &flakyOutput{down: true, err: unavailable}, 0)
+	if err := s.WriteMeasurements(testMeasurements("mp1", start, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A run without new points still replays
+	out := &flakyOutput{}
+	s, _ = testSpool(t, dir, out, 0)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.written) != 2 {
+		t.Errorf("expected 2 replayed points, got %d", len(out.written))
+	}
+}
+
+func TestSpoolTruncatedLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	hms := testMeasurements("mp1", start, 3)
+
+	s, _ := testSpool(t, dir, &flakyOutput{down: true, err: unavailable}, 0)
+	if err := s.WriteMeasurements(hms[:1]); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash in the middle of an append
+	path := filepath.Join(dir, "test.spool")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"MeteringPointId":"mp1","Timest`))
+	f.Close()
+
+	// The next append starts on a line of its own
+	s, _ = testSpool(t, dir, &flakyOutput{down: true, err: unavailable}, 0)
+	if err := s.WriteMeasurements(hms[1:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &flakyOutput{}
+	s, messages := testSpool(t, dir, out, 0)
+	if err := s.WriteMeasurements(hms[2:]); err != nil {
+		t.Fatal(err)
+	}
+	if got := timestamps(out.written); len(got) != 3 || got[0] != hms[0].Timestamp.Unix() ||
+		got[1] != hms[1].Timestamp.Unix() || got[2] != hms[2].Timestamp.Unix() {
+
+		t.Errorf("expected all complete points, got %v", got)
+	}
+	if !strings.HasPrefix(messages.String(), "WARNING: Skipping corrupt entry in spool ") {
+		t.Errorf("expected a corrupt entry warning, got %q", messages.String())
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s, _ := testSpool(t, dir, &flakyOutput{down: true, err: unavailable}, 10)
+	err = s.WriteMeasurements(testMeasurements("mp1", start, 2))
+	if err == nil || !strings.Contains(err.Error(), "is full, dropped 2 points") {
+		t.Fatalf("expected a spool full error, got %v", err)
+	}
+}
+
+func TestSpoolRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	rejected := wrapError(&statusError{code: http.StatusBadRequest, status: "400 Bad Request", msg: "partial write"}, "Cannot write points")
+	s, messages := testSpool(t, dir, &flakyOutput{down: true, err: rejected}, 0)
+	if err := s.WriteMeasurements(testMeasurements("mp1", start, 2)); err != rejected {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.spool")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be spooled, got %v", err)
+	}
+	if messages.Len() != 0 {
+		t.Errorf("unexpected messages: %q", messages.String())
+	}
+}
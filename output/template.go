@@ -0,0 +1,155 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+type TemplateConfig struct {
+	Path string
+}
+
+func init() {
+	RegisterWriter("template", func(opts *Options) (Output, error) {
+		if opts.Template == nil || opts.Template.Path == "" {
+			return nil, fmt.Errorf("template output requires a template file")
+		}
+		src, err := ioutil.ReadFile(opts.Template.Path)
+		if err != nil {
+			return nil, err
+		}
+		return NewTemplateOutput(opts.Writer, filepath.Base(opts.Template.Path), string(src), opts.Location, opts.Query)
+	})
+}
+
+// TemplateData is the root object passed to user templates
+type TemplateData struct {
+	Query          *Query
+	MeteringPoints []caruna.MeteringPoint
+	Measurements   []caruna.HourlyEnergyMeasurement
+	Location       *time.Location
+}
+
+// TemplateOutput renders everything through a text/template on Close
+type TemplateOutput struct {
+	w    io.Writer
+	tmpl *template.Template
+	data *TemplateData
+}
+
+func (self *TemplateOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	self.data.MeteringPoints = append(self.data.MeteringPoints, mps...)
+	return nil
+}
+
+func (self *TemplateOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	self.data.Measurements = append(self.data.Measurements, hms...)
+	return nil
+}
+
+func (self *TemplateOutput) Close() error {
+	if self.data.MeteringPoints == nil && self.data.Query != nil {
+		self.data.MeteringPoints = self.data.Query.MeteringPoints
+	}
+	// Render into a buffer so that a failing template doesn't leave partial output
+	buf := &bytes.Buffer{}
+	if err := self.tmpl.Execute(buf, self.data); err != nil {
+		return err
+	}
+	_, err := self.w.Write(buf.Bytes())
+	return err
+}
+
+func NewTemplateOutput(w io.Writer, name, src string, loc *time.Location, query *Query) (*TemplateOutput, error) {
+	tmpl, err := template.New(name).Funcs(TemplateFuncs(loc)).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplateOutput{
+		w:    w,
+		tmpl: tmpl,
+		data: &TemplateData{Query: query, Location: loc},
+	}, nil
+}
+
+// TemplateFuncs returns the helper functions available in templates. Times are
+// formatted in loc unless another zone is requested explicitly.
+func TemplateFuncs(loc *time.Location) template.FuncMap {
+	return template.FuncMap{
+		"sum": sumValues,
+		"groupByPoint": func(hms []caruna.HourlyEnergyMeasurement) []*Group {
+			return GroupByMeteringPoint(hms)
+		},
+		"groupByDay": func(hms []caruna.HourlyEnergyMeasurement) ([]*Group, error) {
+			return GroupByPeriod(hms, PeriodDay, loc)
+		},
+		"groupBy": func(period string, hms []caruna.HourlyEnergyMeasurement) ([]*Group, error) {
+			return GroupByPeriod(hms, period, loc)
+		},
+		// {{.Timestamp | formatTime "2006-01-02 15:04"}}
+		"formatTime": func(layout string, t time.Time) string {
+			return t.In(loc).Format(layout)
+		},
+		// {{formatTimeIn "UTC" "15:04" .Timestamp}}
+		"formatTimeIn": func(zone, layout string, t time.Time) (string, error) {
+			l, err := time.LoadLocation(zone)
+			if err != nil {
+				return "", err
+			}
+			return t.In(l).Format(layout), nil
+		},
+		"location": func(parts []string) string {
+			return strings.Join(parts, " ")
+		},
+		// {{formatNumber "fi" 2 .Value}} gives 1 234,56
+		"formatNumber": FormatNumber,
+	}
+}
+
+// Thousands and decimal separators per locale
+var numberLocales = map[string][2]string{
+	"":   {"", "."},
+	"en": {",", "."},
+	"fi": {" ", ","},
+	"sv": {" ", ","},
+	"de": {".", ","},
+}
+
+// FormatNumber formats v with the given number of decimals using locale separators
+func FormatNumber(locale string, decimals int, v float64) (string, error) {
+	seps, ok := numberLocales[strings.ToLower(locale)]
+	if !ok {
+		return "", fmt.Errorf("unknown number locale: %s", locale)
+	}
+	s := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+	intPart, fracPart := s, ""
+	if i := strings.Index(s, "."); i != -1 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+
+	buf := &bytes.Buffer{}
+	if v < 0 && s != strconv.FormatFloat(0, 'f', decimals, 64) {
+		buf.WriteString("-")
+	}
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			buf.WriteString(seps[0])
+		}
+		buf.WriteRune(c)
+	}
+	if fracPart != "" {
+		buf.WriteString(seps[1])
+		buf.WriteString(fracPart)
+	}
+	return buf.String(), nil
+}
@@ -1,53 +1,145 @@
 package output
 
 import (
+	"bytes"
 	"fmt"
-	"os"
+	"io"
 	"strings"
 	"text/tabwriter"
 	"time"
 
 	"github.com/aakso/gcaruna/client"
+	"github.com/aakso/gcaruna/reconcile"
 )
 
-func PrintTextMeteringPoints(mps []caruna.MeteringPoint) {
+type TextConfig struct {
+	// Roll hourly values up by day, week or month, empty prints every hour
+	Group string
+}
+
+func init() {
+	RegisterWriter("text", func(opts *Options) (Output, error) {
+		config := opts.Text
+		if config == nil {
+			config = &TextConfig{}
+		}
+		return NewTextOutput(opts.Writer, opts.Location, config)
+	})
+}
+
+// TextOutput prints human readable tables, timestamps are shown in the display zone.
+// Measurements are grouped by metering point and printed on Close.
+type TextOutput struct {
+	w            io.Writer
+	loc          *time.Location
+	config       *TextConfig
+	measurements []caruna.HourlyEnergyMeasurement
+}
+
+func (self *TextOutput) WriteMeteringPoints(mps []caruna.MeteringPoint) error {
+	buf := &bytes.Buffer{}
 	for i, e := range mps {
 		if i != 0 {
-			fmt.Println()
+			fmt.Fprintln(buf)
 		}
-		fmt.Printf("Metering point %d:\n", i)
-		fmt.Printf("%-20s%s\n", "Location:", strings.Join(e.Location, " "))
-		fmt.Printf("%-20s%s\n", "Id:", e.MeteringPointNumber)
-		fmt.Printf("%-20s%s\n", "Type:", e.MeteringPointType)
-		fmt.Printf("%-20s%t\n", "Hourly measured:", e.HourlyMeasured)
-		fmt.Printf("%-20s%s\n", "Contract begin:", e.Created)
+		fmt.Fprintf(buf, "Metering point %d:\n", i)
+		fmt.Fprintf(buf, "%-20s%s\n", "Location:", strings.Join(e.Location, " "))
+		fmt.Fprintf(buf, "%-20s%s\n", "Id:", e.MeteringPointNumber)
+		fmt.Fprintf(buf, "%-20s%s\n", "Type:", e.MeteringPointType)
+		fmt.Fprintf(buf, "%-20s%t\n", "Hourly measured:", e.HourlyMeasured)
+		fmt.Fprintf(buf, "%-20s%s\n", "Contract begin:", e.Created)
 
 	}
+	_, err := self.w.Write(buf.Bytes())
+	return err
+}
+
+func (self *TextOutput) WriteMeasurements(hms []caruna.HourlyEnergyMeasurement) error {
+	self.measurements = append(self.measurements, hms...)
+	return nil
+}
+
+func (self *TextOutput) writeMeteringPointSummary(w io.Writer, point *Group) error {
+	first := point.Measurements[0]
+	fmt.Fprintf(w, "Metering point %s (%s):\n", point.Key, strings.Join(first.MeteringPointLocation, " "))
+
+	if self.config.Group == "" {
+		fmt.Fprintln(w, strings.Join([]string{"Ts", "KWh"}, "\t"))
+		for _, e := range point.Measurements {
+			fmt.Fprintf(w, "%s\t%f\n", e.Timestamp.In(self.loc).Format(time.RFC3339), e.Value)
+		}
+		fmt.Fprintln(w, strings.Join([]string{"", "KWh", "Min", "Max", "Avg", "Peak hour"}, "\t"))
+	} else {
+		periods, err := GroupByPeriod(point.Measurements, self.config.Group, self.loc)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, strings.Join([]string{"Period", "KWh", "Min", "Max", "Avg", "Peak hour"}, "\t"))
+		for _, p := range periods {
+			fmt.Fprintln(w, strings.Join([]string{p.Key, self.summaryColumns(p)}, "\t"))
+		}
+	}
+	fmt.Fprintln(w, strings.Join([]string{"Total", self.summaryColumns(point)}, "\t"))
+	return nil
+}
+
+func (self *TextOutput) summaryColumns(g *Group) string {
+	peak := g.Peak()
+	return strings.Join([]string{
+		fmt.Sprintf("%f", g.Sum()),
+		fmt.Sprintf("%f", g.Min()),
+		fmt.Sprintf("%f", g.Max()),
+		fmt.Sprintf("%f", g.Avg()),
+		peak.Timestamp.In(self.loc).Format(time.RFC3339),
+	}, "\t")
 }
 
-func PrintTextHourlyMeasurements(hms []caruna.HourlyEnergyMeasurement) {
-	w := tabwriter.NewWriter(os.Stdout, 30, 8, 0, '\t', 0)
-	header := []string{"Ts", "Loc", "KWh"}
+func (self *TextOutput) WriteReconcileReport(diffs []reconcile.HourDifference) error {
+	w := tabwriter.NewWriter(self.w, 30, 8, 0, '\t', 0)
+	header := []string{"Ts", "Loc", "Datahub KWh", "Caruna KWh", "Diff"}
 	fmt.Fprintln(w, strings.Join(header, "\t"))
-	sum := 0.0
-	for _, e := range hms {
+	for _, e := range diffs {
 		line := []string{
-			e.Timestamp.Format(time.RFC3339),
+			e.Timestamp.In(self.loc).Format(time.RFC3339),
 			strings.Join(e.MeteringPointLocation, " "),
-			fmt.Sprintf("%f", e.Value),
+			formatOptional(e.Datahub),
+			formatOptional(e.Caruna),
+			fmt.Sprintf("%f", e.Delta),
 		}
 		fmt.Fprintln(w, strings.Join(line, "\t"))
-		sum += e.Value
 	}
-	fmt.Fprintf(w, "\t\tSum: %f\n", sum)
-	w.Flush()
+	fmt.Fprintf(w, "\t\tDiffering hours: %d\n", len(diffs))
+	return w.Flush()
+}
+
+func (self *TextOutput) Close() error {
+	if len(self.measurements) == 0 {
+		return nil
+	}
+	w := tabwriter.NewWriter(self.w, 12, 8, 2, ' ', 0)
+	for i, point := range GroupByMeteringPoint(self.measurements) {
+		if i != 0 {
+			fmt.Fprintln(w)
+		}
+		if err := self.writeMeteringPointSummary(w, point); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func formatOptional(v *float64) string {
+	if v == nil {
+		return "missing"
+	}
+	return fmt.Sprintf("%f", *v)
 }
 
-func PrintTextOutput(output interface{}) {
-	switch v := output.(type) {
-	case []caruna.MeteringPoint:
-		PrintTextMeteringPoints(v)
-	case []caruna.HourlyEnergyMeasurement:
-		PrintTextHourlyMeasurements(v)
+func NewTextOutput(w io.Writer, loc *time.Location, config *TextConfig) (*TextOutput, error) {
+	switch config.Group {
+	case "", PeriodDay, PeriodWeek, PeriodMonth:
+	default:
+		return nil, fmt.Errorf("unknown text grouping: %s", config.Group)
 	}
+	return &TextOutput{w: w, loc: loc, config: config}, nil
 }
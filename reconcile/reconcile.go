@@ -0,0 +1,102 @@
+package reconcile
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+// HourDifference is one hour where Datahub and Caruna disagree. A nil value means
+// the hour is missing from that source.
+type HourDifference struct {
+	MeteringPointId       string
+	MeteringPointLocation []string
+	Timestamp             time.Time
+	Datahub               *float64
+	Caruna                *float64
+	Delta                 float64
+}
+
+// Compare lists hours where the values differ more than tolerance. Mapping translates
+// Datahub GSRN ids to Caruna metering point numbers, unmapped ids are compared as is.
+// Unmapped ids that Caruna doesn't know are left out and returned as unmatched.
+func Compare(datahubValues, carunaValues []caruna.HourlyEnergyMeasurement, mapping map[string]string, tolerance float64) ([]HourDifference, []string) {
+	type hour struct {
+		id string
+		ts int64
+	}
+	index := make(map[hour]*HourDifference)
+	known := make(map[string]bool)
+	for _, e := range carunaValues {
+		known[e.MeteringPointId] = true
+	}
+	unmatched := make(map[string]bool)
+	keys := make([]hour, 0)
+
+	get := func(id string, loc []string, ts time.Time) *HourDifference {
+		k := hour{id, ts.Unix()}
+		d, ok := index[k]
+		if !ok {
+			d = &HourDifference{
+				MeteringPointId:       id,
+				MeteringPointLocation: loc,
+				Timestamp:             ts,
+			}
+			index[k] = d
+			keys = append(keys, k)
+		}
+		return d
+	}
+
+	for _, e := range datahubValues {
+		id := e.MeteringPointId
+		if mapped, ok := mapping[id]; ok {
+			id = mapped
+		} else if !known[id] {
+			unmatched[id] = true
+			continue
+		}
+		v := e.Value
+		get(id, e.MeteringPointLocation, e.Timestamp).Datahub = &v
+	}
+	for _, e := range carunaValues {
+		v := e.Value
+		d := get(e.MeteringPointId, e.MeteringPointLocation, e.Timestamp)
+		// Prefer the address known by Caruna
+		d.MeteringPointLocation = e.MeteringPointLocation
+		d.Caruna = &v
+	}
+
+	ret := make([]HourDifference, 0)
+	for _, k := range keys {
+		d := index[k]
+		if d.Datahub != nil && d.Caruna != nil {
+			d.Delta = *d.Caruna - *d.Datahub
+			if math.Abs(d.Delta) <= tolerance {
+				continue
+			}
+		}
+		ret = append(ret, *d)
+	}
+	sort.Sort(byPointAndTime(ret))
+
+	ids := make([]string, 0, len(unmatched))
+	for id := range unmatched {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ret, ids
+}
+
+type byPointAndTime []HourDifference
+
+func (s byPointAndTime) Len() int      { return len(s) }
+func (s byPointAndTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPointAndTime) Less(i, j int) bool {
+	if s[i].MeteringPointId != s[j].MeteringPointId {
+		return s[i].MeteringPointId < s[j].MeteringPointId
+	}
+	return s[i].Timestamp.Before(s[j].Timestamp)
+}
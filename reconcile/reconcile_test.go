@@ -0,0 +1,120 @@
+package reconcile
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/gcaruna/client"
+)
+
+var (
+	start   = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	missing = math.NaN()
+)
+
+// series returns one value per hour from start, missing hours are left out
+func series(id string, values ...float64) []caruna.HourlyEnergyMeasurement {
+	ret := make([]caruna.HourlyEnergyMeasurement, 0)
+	for i, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		ret = append(ret, caruna.HourlyEnergyMeasurement{
+			MeteringPointId:       id,
+			MeteringPointLocation: []string{id + " address"},
+			Timestamp:             start.Add(time.Duration(i) * time.Hour),
+			Value:                 v,
+		})
+	}
+	return ret
+}
+
+// describe formats diffs as id@hour:datahub/caruna, a missing value is -
+func describe(diffs []HourDifference) string {
+	value := func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	}
+	ret := make([]string, len(diffs))
+	for i, d := range diffs {
+		ret[i] = d.MeteringPointId + "@" + d.Timestamp.Format("15") + ":" + value(d.Datahub) + "/" + value(d.Caruna)
+	}
+	return strings.Join(ret, " ")
+}
+
+func TestCompareTolerance(t *testing.T) {
+	datahub := series("mp1", 1, 1, 1, 1)
+	carunaValues := series("mp1", 1, 1.04, 1.1, 0.8)
+	diffs, unmatched := Compare(datahub, carunaValues, nil, 0.05)
+	if got, want := describe(diffs), "mp1@02:1/1.1 mp1@03:1/0.8"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if len(unmatched) != 0 {
+		t.Errorf("unexpected unmatched ids %v", unmatched)
+	}
+	if len(diffs) == 2 && math.Abs(diffs[1].Delta+0.2) > 1e-9 {
+		t.Errorf("expected delta -0.2, got %v", diffs[1].Delta)
+	}
+
+	// Zero tolerance reports every difference
+	diffs, _ = Compare(datahub, carunaValues, nil, 0)
+	if len(diffs) != 3 {
+		t.Errorf("expected 3 differences, got %s", describe(diffs))
+	}
+}
+
+func TestCompareMissing(t *testing.T) {
+	datahub := series("mp1", 1, missing, 1, 1)
+	carunaValues := series("mp1", 1, 1, 1, missing)
+	diffs, _ := Compare(datahub, carunaValues, nil, 0.05)
+	if got, want := describe(diffs), "mp1@01:-/1 mp1@03:1/-"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	for _, d := range diffs {
+		if d.Delta != 0 {
+			t.Errorf("expected no delta for a missing hour, got %v", d.Delta)
+		}
+	}
+}
+
+func TestCompareMapping(t *testing.T) {
+	datahub := append(series("643000000000000001", 1, 2), series("643000000000000002", 5, missing)...)
+	carunaValues := append(series("mp2", 5, 5), series("mp1", 1, 3)...)
+	mapping := map[string]string{"643000000000000001": "mp1", "643000000000000002": "mp2"}
+	diffs, unmatched := Compare(datahub, carunaValues, mapping, 0.05)
+	// Sorted by Caruna id and time, the address comes from Caruna
+	if got, want := describe(diffs), "mp1@01:2/3 mp2@01:-/5"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if len(diffs) > 0 && diffs[0].MeteringPointLocation[0] != "mp1 address" {
+		t.Errorf("expected the Caruna address, got %v", diffs[0].MeteringPointLocation)
+	}
+	if len(unmatched) != 0 {
+		t.Errorf("unexpected unmatched ids %v", unmatched)
+	}
+}
+
+func TestCompareUnmapped(t *testing.T) {
+	// Datahub already uses the Caruna id
+	datahub := append(series("mp1", 1, 2), series("643000000000000009", 1, 1)...)
+	datahub = append(datahub, series("643000000000000008", 1)...)
+	carunaValues := series("mp1", 1, 2)
+	diffs, unmatched := Compare(datahub, carunaValues, nil, 0.05)
+	if len(diffs) != 0 {
+		t.Errorf("expected no differences, got %s", describe(diffs))
+	}
+	if got := strings.Join(unmatched, ","); got != "643000000000000008,643000000000000009" {
+		t.Errorf("unmatched = %s", got)
+	}
+
+	// A mapped id is compared even when Caruna has no values for it
+	diffs, unmatched = Compare(series("643000000000000009", 1), nil, map[string]string{"643000000000000009": "mp9"}, 0.05)
+	if got, want := describe(diffs), "mp9@00:1/-"; got != want || len(unmatched) != 0 {
+		t.Errorf("got %s and unmatched %v, want %s", got, unmatched, want)
+	}
+}
@@ -0,0 +1,186 @@
+// Package timerange resolves human friendly and calendar aligned time range
+// expressions. Calendar boundaries are computed in a given location and stop
+// times are exclusive.
+package timerange
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	relativeRe = regexp.MustCompile(`^([+-]?)(\d+)([smhdwy])$`)
+	yearRe     = regexp.MustCompile(`^\d{4}$`)
+	monthRe    = regexp.MustCompile(`^\d{4}-\d{2}$`)
+	dayRe      = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+)
+
+// Parse resolves a range expression into [start, stop). Supported expressions:
+//
+//	today, yesterday, this-week, last-week, this-month, last-month, this-year, last-year
+//	2024, 2024-03, 2024-03-15
+//	<time>..<time>   where both ends are anything ParseTime accepts, a date end is inclusive
+//
+// Returned times are in UTC.
+func Parse(expr string, now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	expr = strings.TrimSpace(expr)
+
+	if i := strings.Index(expr, ".."); i != -1 {
+		startExpr, stopExpr := expr[:i], expr[i+2:]
+		start, _, err := parseBound(startExpr, now, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		// A calendar period at the end means up to the end of that period
+		_, stop, err := parseBound(stopExpr, now, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		if !start.Before(stop) {
+			return time.Time{}, time.Time{}, fmt.Errorf("Empty time range: %s", expr)
+		}
+		return start, stop, nil
+	}
+
+	start, stop, err := parsePeriod(expr, now, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return start, stop, nil
+}
+
+// ParseTime resolves a single point in time. Accepts RFC3339, local dates and date times,
+// "now" and durations relative to now such as -48h, -7d, -1w or -1h30m. Durations
+// without a sign are in the past, +2d is in the future.
+func ParseTime(s string, now time.Time, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "now" {
+		return now.UTC(), nil
+	}
+	if ts, err := time.Parse(time.RFC3339, s); err == nil {
+		return ts.UTC(), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if ts, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return ts.UTC(), nil
+		}
+	}
+	if ts, ok := parseRelative(s, now, loc); ok {
+		return ts.UTC(), nil
+	}
+	// Calendar periods resolve to their beginning
+	if start, _, err := parsePeriod(s, now, loc); err == nil {
+		return start, nil
+	}
+	return time.Time{}, fmt.Errorf("Cannot parse time: %s", s)
+}
+
+// parseBound resolves one end of a ".." range. Periods keep both of their ends,
+// points in time are returned as an empty period.
+func parseBound(s string, now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	if start, stop, err := parsePeriod(s, now, loc); err == nil {
+		return start, stop, nil
+	}
+	ts, err := ParseTime(s, now, loc)
+	return ts, ts, err
+}
+
+func parsePeriod(expr string, now time.Time, loc *time.Location) (time.Time, time.Time, error) {
+	now = now.In(loc)
+	today := midnight(now)
+
+	var start, stop time.Time
+	switch {
+	case expr == "today":
+		start, stop = today, today.AddDate(0, 0, 1)
+	case expr == "yesterday":
+		start, stop = today.AddDate(0, 0, -1), today
+	case expr == "this-week":
+		start = weekStart(today)
+		stop = start.AddDate(0, 0, 7)
+	case expr == "last-week":
+		stop = weekStart(today)
+		start = stop.AddDate(0, 0, -7)
+	case expr == "this-month":
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		stop = start.AddDate(0, 1, 0)
+	case expr == "last-month":
+		stop = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		start = stop.AddDate(0, -1, 0)
+	case expr == "this-year":
+		start = time.Date(now.Year(), 1, 1, 0, 0, 0, 0, loc)
+		stop = start.AddDate(1, 0, 0)
+	case expr == "last-year":
+		stop = time.Date(now.Year(), 1, 1, 0, 0, 0, 0, loc)
+		start = stop.AddDate(-1, 0, 0)
+	case yearRe.MatchString(expr):
+		year, _ := strconv.Atoi(expr)
+		start = time.Date(year, 1, 1, 0, 0, 0, 0, loc)
+		stop = start.AddDate(1, 0, 0)
+	case monthRe.MatchString(expr):
+		ts, err := time.ParseInLocation("2006-01", expr, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		start, stop = ts, ts.AddDate(0, 1, 0)
+	case dayRe.MatchString(expr):
+		ts, err := time.ParseInLocation("2006-01-02", expr, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		start, stop = ts, ts.AddDate(0, 0, 1)
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("Unknown time range: %s", expr)
+	}
+	return start.UTC(), stop.UTC(), nil
+}
+
+// parseRelative handles durations from now. Days, weeks and years follow the
+// calendar in loc so that -1d is the same wall clock time yesterday.
+func parseRelative(s string, now time.Time, loc *time.Location) (time.Time, bool) {
+	m := relativeRe.FindStringSubmatch(s)
+	if m == nil {
+		// Fall back to Go durations such as -1h30m, with the same sign rule
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if !strings.HasPrefix(s, "+") && d > 0 {
+			d = -d
+		}
+		return now.Add(d), true
+	}
+	n, _ := strconv.Atoi(m[2])
+	if m[1] != "+" {
+		n = -n
+	}
+	now = now.In(loc)
+	switch m[3] {
+	case "s":
+		return now.Add(time.Duration(n) * time.Second), true
+	case "m":
+		return now.Add(time.Duration(n) * time.Minute), true
+	case "h":
+		return now.Add(time.Duration(n) * time.Hour), true
+	case "d":
+		return now.AddDate(0, 0, n), true
+	case "w":
+		return now.AddDate(0, 0, 7*n), true
+	case "y":
+		return now.AddDate(n, 0, 0), true
+	}
+	return time.Time{}, false
+}
+
+func midnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// Weeks start on monday
+func weekStart(day time.Time) time.Time {
+	offset := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -offset)
+}
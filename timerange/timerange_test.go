@@ -0,0 +1,122 @@
+package timerange
+
+import (
+	"testing"
+	"time"
+)
+
+func helsinki(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation("Europe/Helsinki")
+	if err != nil {
+		t.Skip("Europe/Helsinki not available:", err)
+	}
+	return loc
+}
+
+func utc(s string) time.Time {
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}
+
+func TestParse(t *testing.T) {
+	loc := helsinki(t)
+	cases := []struct {
+		expr        string
+		now         string
+		start, stop string
+	}{
+		// Spring forward day has 23 hours
+		{"today", "2024-03-31T10:00:00+03:00", "2024-03-30T22:00:00Z", "2024-03-31T21:00:00Z"},
+		// Fall back day has 25 hours
+		{"yesterday", "2024-10-28T10:00:00+02:00", "2024-10-26T21:00:00Z", "2024-10-27T22:00:00Z"},
+		// Local date is ahead of UTC just after midnight
+		{"today", "2025-01-01T00:30:00+02:00", "2024-12-31T22:00:00Z", "2025-01-01T22:00:00Z"},
+		{"yesterday", "2025-01-01T00:30:00+02:00", "2024-12-30T22:00:00Z", "2024-12-31T22:00:00Z"},
+		{"this-year", "2025-01-01T00:30:00+02:00", "2024-12-31T22:00:00Z", "2025-12-31T22:00:00Z"},
+		// Sunday, the week spans the DST change
+		{"this-week", "2024-03-31T10:00:00+03:00", "2024-03-24T22:00:00Z", "2024-03-31T21:00:00Z"},
+		{"last-week", "2024-04-01T10:00:00+03:00", "2024-03-24T22:00:00Z", "2024-03-31T21:00:00Z"},
+		{"this-month", "2024-10-31T23:30:00+02:00", "2024-09-30T21:00:00Z", "2024-10-31T22:00:00Z"},
+		// Year rollover
+		{"last-month", "2024-01-15T12:00:00+02:00", "2023-11-30T22:00:00Z", "2023-12-31T22:00:00Z"},
+		// Leap february
+		{"last-month", "2024-03-31T12:00:00+03:00", "2024-01-31T22:00:00Z", "2024-02-29T22:00:00Z"},
+		{"last-year", "2024-06-01T12:00:00+03:00", "2022-12-31T22:00:00Z", "2023-12-31T22:00:00Z"},
+		{"2024-03", "2024-06-01T12:00:00+03:00", "2024-02-29T22:00:00Z", "2024-03-31T21:00:00Z"},
+		{"2024-12", "2024-06-01T12:00:00+03:00", "2024-11-30T22:00:00Z", "2024-12-31T22:00:00Z"},
+		{"2024", "2024-06-01T12:00:00+03:00", "2023-12-31T22:00:00Z", "2024-12-31T22:00:00Z"},
+		{"2024-10-27", "2024-06-01T12:00:00+03:00", "2024-10-26T21:00:00Z", "2024-10-27T22:00:00Z"},
+		// Date ends are inclusive, periods at the end run to their end
+		{"2024-03-30..2024-03-31", "2024-06-01T12:00:00+03:00", "2024-03-29T22:00:00Z", "2024-03-31T21:00:00Z"},
+		{"2024-01..2024-03", "2024-06-01T12:00:00+03:00", "2023-12-31T22:00:00Z", "2024-03-31T21:00:00Z"},
+		{"2024-12-31T10:00:00Z..now", "2025-01-01T00:30:00+02:00", "2024-12-31T10:00:00Z", "2024-12-31T22:30:00Z"},
+		{"last-month..today", "2024-01-15T12:00:00+02:00", "2023-11-30T22:00:00Z", "2024-01-15T22:00:00Z"},
+		{"-2d..now", "2024-04-01T12:00:00+03:00", "2024-03-30T10:00:00Z", "2024-04-01T09:00:00Z"},
+	}
+	for _, c := range cases {
+		start, stop, err := Parse(c.expr, utc(c.now), loc)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+		if !start.Equal(utc(c.start)) || !stop.Equal(utc(c.stop)) {
+			t.Errorf("%s at %s: got %s - %s, want %s - %s", c.expr, c.now, start, stop, c.start, c.stop)
+		}
+		if start.Location() != time.UTC || stop.Location() != time.UTC {
+			t.Errorf("%s: times are not UTC", c.expr)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	loc := helsinki(t)
+	now := utc("2024-06-01T12:00:00Z")
+	for _, expr := range []string{"", "tomorrow", "2024-13", "2024-03-31..2024-03-01", "now..now"} {
+		if start, stop, err := Parse(expr, now, loc); err == nil {
+			t.Errorf("%q: expected an error, got %s - %s", expr, start, stop)
+		}
+	}
+}
+
+func TestParseTimeRelative(t *testing.T) {
+	loc := helsinki(t)
+	// The day after spring forward, a day ago was 23 hours ago
+	now := utc("2024-04-01T02:00:00+03:00")
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{"now", "2024-03-31T23:00:00Z"},
+		{"-1d", "2024-03-31T00:00:00Z"},
+		{"1d", "2024-03-31T00:00:00Z"},
+		{"+1d", "2024-04-02T02:00:00+03:00"},
+		{"-2d", "2024-03-30T02:00:00+02:00"},
+		{"-1w", "2024-03-25T02:00:00+02:00"},
+		{"-1y", "2023-04-01T02:00:00+03:00"},
+		{"-48h", "2024-03-29T23:00:00Z"},
+		{"48h", "2024-03-29T23:00:00Z"},
+		{"+1h", "2024-04-01T00:00:00Z"},
+		// Go durations follow the same sign rule
+		{"-1h30m", "2024-03-31T21:30:00Z"},
+		{"1h30m", "2024-03-31T21:30:00Z"},
+		{"+1h30m", "2024-04-01T00:30:00Z"},
+		// Absolute times
+		{"2024-03-31", "2024-03-30T22:00:00Z"},
+		{"2024-03-31T12:00", "2024-03-31T09:00:00Z"},
+		{"2024-03-31T12:00:00+01:00", "2024-03-31T11:00:00Z"},
+		{"last-month", "2024-02-29T22:00:00Z"},
+	}
+	for _, c := range cases {
+		got, err := ParseTime(c.expr, now, loc)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+		if !got.Equal(utc(c.want)) {
+			t.Errorf("%s: got %s, want %s", c.expr, got, utc(c.want).UTC())
+		}
+	}
+}